@@ -0,0 +1,152 @@
+package perfect
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+const (
+	//the Cache-Control value of fingerprinted assets. Their contents never
+	//change, since a new version has a new name.
+	ASSET_CACHE_CONTROL = "public, max-age=31536000, immutable"
+	//the number of hex digits of the content hash in fingerprinted names
+	ASSET_HASH_LENGTH = 8
+)
+
+//Maps static files to fingerprinted names that contain the hash of their
+//contents, i.e. js/app.js -> js/app.3f9a1c2b.js, so that browsers can cache
+//them forever. Paths are relative to the static prefix.
+type AssetManifest struct {
+	assets map[string]string
+	files  map[string]string
+}
+
+//returns the fingerprinted name of a file, i.e. app.min.js -> app.min.<hash>.js
+func fingerprint(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+//Hashes the files in fsys, and returns their manifest. Precompressed
+//variants (.gz, .br) of other files are served with them, so they don't
+//get names of their own.
+func NewAssetManifest(fsys fs.FS) (*AssetManifest, error) {
+	names := map[string]bool{}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			names[name] = true
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &AssetManifest{
+		assets: make(map[string]string, len(names)),
+		files:  make(map[string]string, len(names)),
+	}
+
+	for name := range names {
+		if variantOf(name, names) {
+			continue
+		}
+
+		//files that can't be served, i.e. links outside of the static
+		//folder, are skipped
+		f, _, err := openRegular(fsys, name)
+		if err != nil {
+			continue
+		}
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprinted := fingerprint(name, hex.EncodeToString(hash.Sum(nil))[:ASSET_HASH_LENGTH])
+
+		manifest.assets[name] = fingerprinted
+		manifest.files[fingerprinted] = name
+	}
+
+	return manifest, nil
+}
+
+//checks whether name is a precompressed variant of another file
+func variantOf(name string, names map[string]bool) bool {
+	for _, e := range staticEncodings {
+		if strings.HasSuffix(name, e.Ext) && names[strings.TrimSuffix(name, e.Ext)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+//returns the fingerprinted name of a file
+func (a *AssetManifest) Lookup(name string) (string, bool) {
+	fingerprinted, ok := a.assets[name]
+	return fingerprinted, ok
+}
+
+//returns the file that has a fingerprinted name
+func (a *AssetManifest) resolve(fingerprinted string) (string, bool) {
+	name, ok := a.files[fingerprinted]
+	return name, ok
+}
+
+//Exports the manifest for external tooling, as an object that maps file
+//names to fingerprinted names
+func (a *AssetManifest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.assets)
+}
+
+//writes the manifest to a JSON file
+func (a *AssetManifest) WriteFile(filename string) error {
+	data, err := json.MarshalIndent(a.assets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+//Hashes the static files of the module, so that the 'asset' template
+//function returns fingerprinted URLs, which are served with immutable cache
+//headers. Call it when the module starts, after the static path was set.
+//Development modules keep using plain URLs, since their files change.
+func (m *Module) BuildAssetManifest() error {
+	prefix := m.StaticPrefix()
+	if len(prefix) == 0 {
+		return ErrNoStaticFiles
+	}
+
+	static := m.StaticFiles()
+	fsys, _ := static.fileSystem(m, prefix)
+
+	manifest, err := NewAssetManifest(fsys)
+	if err != nil {
+		return err
+	}
+
+	static.SetManifest(manifest)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package perfect
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+//returns the fingerprinted name that a file with the given contents gets
+func fingerprintOf(name, content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return fingerprint(name, hex.EncodeToString(hash[:])[:ASSET_HASH_LENGTH])
+}
+
+func TestAssetManifest(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	if err := module.BuildAssetManifest(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	app := fingerprintOf("app.js", "console.log('app');")
+	site := fingerprintOf("css/site.css", "body{}")
+
+	manifest := module.StaticFiles().Manifest()
+
+	tests := []struct {
+		Name          string
+		Fingerprinted string
+	}{
+		{"app.js", app},
+		{"css/site.css", site},
+		{"vendor/lib.js", fingerprintOf("vendor/lib.js", "lib")},
+		//precompressed variants are served with their file
+		{"app.js.gz", ""},
+		{"app.js.br", ""},
+		//links outside of the static folder are not served
+		{"secret.txt", ""},
+	}
+
+	for _, test := range tests {
+		if fingerprinted, _ := manifest.Lookup(test.Name); fingerprinted != test.Fingerprinted {
+			t.Errorf("%v: fingerprinted = %v, expected %v", test.Name, fingerprinted, test.Fingerprinted)
+		}
+	}
+
+	exported := map[string]string{}
+	data, err := json.Marshal(manifest)
+	if err != nil || json.Unmarshal(data, &exported) != nil || exported["app.js"] != app || len(exported) != 4 {
+		t.Errorf("manifest = %s, err = %v", data, err)
+	}
+}
+
+func TestAssetManifest_Serve(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	if err := module.BuildAssetManifest(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	app := "/static/" + fingerprintOf("app.js", "console.log('app');")
+
+	tests := []struct {
+		Path         string
+		Header       map[string]string
+		Status       int
+		Body         string
+		CacheControl string
+	}{
+		{app, nil, http.StatusOK, "console.log('app');", ASSET_CACHE_CONTROL},
+		{app, map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, "gzipped app", ASSET_CACHE_CONTROL},
+		{"/static/app.js", nil, http.StatusOK, "console.log('app');", STATIC_CACHE_CONTROL},
+		{"/static/app.00000000.js", nil, http.StatusNotFound, "", ""},
+	}
+
+	for _, test := range tests {
+		w := getStatic(module, test.Path, test.Header)
+
+		if w.Code != test.Status {
+			t.Errorf("%v: status = %v, expected %v", test.Path, w.Code, test.Status)
+			continue
+		}
+
+		if test.Status == http.StatusOK && (w.Body.String() != test.Body || w.Header().Get("Cache-Control") != test.CacheControl) {
+			t.Errorf("%v: body = %q, Cache-Control = %v, expected %q, %v", test.Path, w.Body.String(), w.Header().Get("Cache-Control"), test.Body, test.CacheControl)
+		}
+	}
+}
+
+func TestAssetManifest_Template(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	writeTemplate(t, dir, "page", `<script src="<% asset "app.js" %>"></script><img src="<% asset "logo.png" %>">`)
+
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if err := module.BuildAssetManifest(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	//files that are not in the manifest keep their names
+	expected := `<script src="/static/` + fingerprintOf("app.js", "console.log('app');") + `"></script><img src="/static/logo.png">`
+	if response := renderTemplate(module, "page", nil); response.Body.String() != expected {
+		t.Errorf("body = %q, expected %q", response.Body.String(), expected)
+	}
+
+	//development modules use plain names
+	module.Development = true
+	expected = `<script src="/static/app.js"></script><img src="/static/logo.png">`
+	if response := renderTemplate(module, "page", nil); response.Body.String() != expected {
+		t.Errorf("body = %q, expected %q", response.Body.String(), expected)
+	}
+}
+
+func TestAssetManifest_FS(t *testing.T) {
+	module := &Module{Name: "assets", Mux: NewPrettyMux()}
+
+	if err := module.BuildAssetManifest(); err != ErrNoStaticFiles {
+		t.Errorf("err = %v, expected %v", err, ErrNoStaticFiles)
+	}
+
+	module.StaticFS("/assets", fstest.MapFS{"app.min.js": {Data: []byte("app")}})
+
+	if err := module.BuildAssetManifest(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if fingerprinted, ok := module.StaticFiles().Manifest().Lookup("app.min.js"); !ok || fingerprinted != fingerprintOf("app.min.js", "app") {
+		t.Errorf("fingerprinted = %v, ok = %v", fingerprinted, ok)
+	}
+}
@@ -7,11 +7,17 @@ import (
 	"github.com/vpetrov/perfect/orm"
 	"log"
 	"net/http"
+	"time"
 )
 
 const (
 	SALT_ENTROPY             = 3
 	BERR_INVALID_CREDENTIALS = "Invalid username or password"
+	BERR_REGISTRATION_FAILED = "Registration failed"
+
+	//how many login and registration attempts a client can make per period
+	LOGIN_ATTEMPTS        = 10
+	LOGIN_ATTEMPTS_PERIOD = time.Minute
 )
 
 type builtinUser struct {
@@ -24,6 +30,9 @@ type builtinUser struct {
 
 type BuiltinStrategy struct {
 	Config *Config
+
+	//limits login and registration attempts; nil disables the limit
+	Limit perfect.Middleware
 }
 
 func NewBuiltinStrategyFunc(config *Config) Strategy {
@@ -33,17 +42,18 @@ func NewBuiltinStrategyFunc(config *Config) Strategy {
 func NewBuiltinStrategy(config *Config) *BuiltinStrategy {
 	return &BuiltinStrategy{
 		Config: config,
+		Limit:  perfect.RateLimit(perfect.SLIDING_WINDOW, LOGIN_ATTEMPTS, LOGIN_ATTEMPTS_PERIOD, perfect.KeyByIP),
 	}
 }
 
 func (b *BuiltinStrategy) Attach(module *perfect.Module) {
 	module.Get("/login", perfect.NotLoggedIn(b.LoginPage))
-	module.Post("/login", perfect.NotLoggedIn(Login))
+	module.Post("/login", b.limit(perfect.NotLoggedIn(Login)))
 
 	//Registration is optional
 	if b.Config.AllowRegistration {
 		module.Get("/register", perfect.NotLoggedIn(b.RegistrationPage))
-		module.Post("/register", perfect.NotLoggedIn(b.Register))
+		module.Post("/register", b.limit(perfect.NotLoggedIn(b.Register)))
 	}
 
 	if len(b.Config.Username) != 0 {
@@ -57,6 +67,17 @@ func (b *BuiltinStrategy) Attach(module *perfect.Module) {
 	}
 }
 
+//wraps a login or registration handler with the limit, if there is one.
+//Only these handlers count attempts, so that requests for other paths can't
+//lock clients out.
+func (b *BuiltinStrategy) limit(handler perfect.RequestHandler) perfect.RequestHandler {
+	if b.Limit == nil {
+		return handler
+	}
+
+	return b.Limit(handler)
+}
+
 func (b *BuiltinStrategy) LoginPage(w http.ResponseWriter, r *perfect.Request) {
 	r.Module.RenderTemplate(w, r, "auth/builtin/login", b.Config)
 }
@@ -125,32 +146,31 @@ func (b *BuiltinStrategy) Register(w http.ResponseWriter, r *perfect.Request) {
 		return
 	}
 
-	data := make(map[string]string)
+	form := &struct {
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
+		Name     string `json:"name" validate:"required"`
+		Email    string `json:"email" validate:"required,email"`
+	}{}
 
-	err = r.ParseJSON(&data)
-	if err != nil {
-		perfect.Error(w, r, err)
+	err = r.Bind(form)
+	if errs, ok := err.(perfect.ValidationErrors); ok {
+		perfect.JSONResult(w, r, false, errs)
 		return
-	}
-
-	username, ok1 := data["username"]
-	password, ok2 := data["password"]
-	name, ok3 := data["name"]
-	email, ok4 := data["email"]
-
-	//TODO: this needs to be refactored into something better
-	if !ok1 || !ok2 || !ok3 || !ok4 || len(username) == 0 || len(password) == 0 || len(name) == 0 || len(email) == 0 {
-		perfect.JSONResult(w, r, false, "Please complete all fields")
+	} else if err != nil {
+		perfect.Error(w, r, err)
 		return
 	}
 
-	_, _, err = createBuiltinProfile(username, password, email, name, r.Module.Db)
+	_, _, err = createBuiltinProfile(form.Username, form.Password, form.Name, form.Email, r.Module.Db)
 	if err != nil {
-		perfect.JSONResult(w, r, true, r.Module.MountPoint+"/")
+		//database errors are only logged, they mean nothing to the client
+		log.Println("registration failed:", err)
+		perfect.JSONResult(w, r, false, BERR_REGISTRATION_FAILED)
 		return
 	}
 
-	perfect.JSONResult(w, r, false, err)
+	perfect.JSONResult(w, r, true, r.Module.MountPoint+"/")
 }
 
 //default logout
@@ -1,7 +1,17 @@
 package auth
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/vpetrov/perfect"
+	"github.com/vpetrov/perfect/orm"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +39,178 @@ func TestNewBuiltinStrategyFunc(t *testing.T) {
 		t.Fatalf("auth strategy is '%#v', expected *BuiltinStrategy", auth_strategy)
 	}
 }
+
+//a database without any users
+type emptyDatabase struct {
+	orm.Database
+}
+
+func (db emptyDatabase) Find(r orm.Record) error {
+	return orm.ErrNotFound
+}
+
+//tests that the login payload, and the password in particular, is never logged
+func TestBuiltinStrategy_LoginLogs(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	module := &perfect.Module{Name: "auth", Db: emptyDatabase{}}
+	strategy := NewBuiltinStrategy(mock_auth_config)
+
+	for _, body := range []string{`{"username":"bob","password":"hunter2"}`, `{"password":"hunter2"`} {
+		request, _ := http.NewRequest("POST", "http://localhost/login", strings.NewReader(body))
+		r := perfect.NewRequest(request, "/login", module)
+
+		_, err := strategy.Login(httptest.NewRecorder(), r)
+		if err == nil {
+			t.Errorf("%v: expected an error", body)
+		}
+	}
+
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("the password was logged:\n%v", logs.String())
+	}
+}
+
+//a database without any users, that accepts new sessions
+type sessionDatabase struct {
+	emptyDatabase
+}
+
+func (db sessionDatabase) Save(r orm.Record) error {
+	return nil
+}
+
+func (db sessionDatabase) UniqueId() string {
+	return "1"
+}
+
+//tests that clients can't keep guessing passwords
+func TestBuiltinStrategy_LoginLimit(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	module := &perfect.Module{Name: "auth", Mux: perfect.NewPrettyMux(), Db: sessionDatabase{}}
+	strategy := NewBuiltinStrategy(&Config{Type: BUILTIN})
+	strategy.Attach(module)
+
+	for i := 0; i <= LOGIN_ATTEMPTS; i++ {
+		request, _ := http.NewRequest("POST", "http://localhost/login", strings.NewReader(`{"username":"bob","password":"hunter2"}`))
+		request.RemoteAddr = "10.0.0.1:1234"
+
+		response := httptest.NewRecorder()
+		module.Route(response, perfect.NewRequest(request, "/login", module))
+
+		expected := http.StatusOK
+		if i == LOGIN_ATTEMPTS {
+			expected = http.StatusTooManyRequests
+		}
+
+		if response.Code != expected {
+			t.Fatalf("attempt %v: status = %v, expected %v", i+1, response.Code, expected)
+		}
+	}
+}
+
+//tests that requests for other paths don't count as login attempts
+func TestBuiltinStrategy_LoginLimitOtherPaths(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(os.Stderr)
+
+	module := &perfect.Module{Name: "auth", Mux: perfect.NewPrettyMux(), Db: sessionDatabase{}}
+	strategy := NewBuiltinStrategy(&Config{Type: BUILTIN})
+	strategy.Attach(module)
+
+	send := func(method, path string) int {
+		request, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(`{"username":"bob","password":"hunter2"}`))
+		request.RemoteAddr = "10.0.0.1:1234"
+
+		response := httptest.NewRecorder()
+		module.Route(response, perfect.NewRequest(request, path, module))
+
+		return response.Code
+	}
+
+	for i := 0; i <= LOGIN_ATTEMPTS; i++ {
+		if code := send("GET", "/favicon.ico"); code != http.StatusNotFound {
+			t.Fatalf("request %v: status = %v, expected %v", i+1, code, http.StatusNotFound)
+		}
+
+		if code := send("DELETE", "/login"); code != http.StatusMethodNotAllowed {
+			t.Fatalf("request %v: status = %v, expected %v", i+1, code, http.StatusMethodNotAllowed)
+		}
+	}
+
+	if code := send("POST", "/login"); code != http.StatusOK {
+		t.Errorf("status = %v, expected %v", code, http.StatusOK)
+	}
+}
+
+//a database without any users, that keeps the profiles it saves and fails
+//to save them if err is set
+type registrationDatabase struct {
+	sessionDatabase
+	profiles []*perfect.Profile
+	err      error
+}
+
+func (db *registrationDatabase) Save(r orm.Record) error {
+	if profile, ok := r.(*perfect.Profile); ok {
+		if db.err != nil {
+			return db.err
+		}
+		db.profiles = append(db.profiles, profile)
+	}
+
+	return nil
+}
+
+func TestBuiltinStrategy_Register(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		Body    string
+		Err     error
+		Success bool
+		Message string
+	}{
+		{`{"username":"bob","password":"hunter2","name":"Bob","email":"bob@example.com"}`, nil, true, `"/auth/"`},
+		{`{"username":"bob","password":"hunter2","name":"Bob"}`, nil, false, `[{"field":"email","rule":"required","message":"is required"}]`},
+		{`{"username":"bob","password":"hunter2","name":"Bob","email":"bob@example.com"}`, errors.New("db1.example.com: connection refused"), false, `"` + BERR_REGISTRATION_FAILED + `"`},
+	}
+
+	for _, test := range tests {
+		db := &registrationDatabase{err: test.Err}
+		module := &perfect.Module{Name: "auth", MountPoint: "/auth", Db: db}
+
+		request, _ := http.NewRequest("POST", "http://localhost/register", strings.NewReader(test.Body))
+		request.Header.Set("Content-Type", "application/json")
+
+		response := httptest.NewRecorder()
+		NewBuiltinStrategy(mock_auth_config).Register(response, perfect.NewRequest(request, "/register", module))
+
+		result := &struct {
+			Success bool
+			Message json.RawMessage
+		}{}
+
+		if err := json.Unmarshal(response.Body.Bytes(), result); err != nil {
+			t.Fatalf("%v: err = %v, body = %v", test.Body, err, response.Body.String())
+		}
+
+		if result.Success != test.Success || string(result.Message) != test.Message {
+			t.Errorf("%v: result = %v, %s, expected %v, %s", test.Body, result.Success, result.Message, test.Success, test.Message)
+		}
+
+		if strings.Contains(response.Body.String(), "connection refused") {
+			t.Errorf("%v: the database error was sent to the client: %v", test.Body, response.Body.String())
+		}
+
+		if test.Success && (len(db.profiles) != 1 || *db.profiles[0].Id != "bob@example.com" || *db.profiles[0].Name != "Bob") {
+			t.Errorf("%v: profiles = %v, expected bob@example.com (Bob)", test.Body, db.profiles)
+		}
+	}
+}
@@ -60,8 +60,6 @@ func (d *Dashboard) GoogleResponse(w http.ResponseWriter, r *survana.Request) {
 		return
 	}
 
-	log.Println("token=", token)
-
 	requestUrl := "https://www.googleapis.com/oauth2/v1/userinfo"
 
 	transport.Token = token
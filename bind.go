@@ -0,0 +1,441 @@
+package perfect
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	//the maximum size of multipart forms kept in memory by Bind
+	BIND_MAX_MEMORY = 32 << 20
+)
+
+//A field that failed to bind or validate
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+//All fields that failed to bind or validate. Can be sent to the client as is,
+//with JSONResult(w, r, false, errs).
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Field + " " + e.Message
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+//validation errors are the client's fault
+func (errs ValidationErrors) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+//a loose check for email addresses: something@domain.tld
+var emailRegexp = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+//Fills the struct that v points to from the request, then validates it.
+//JSON bodies are decoded into v, and form bodies are bound like query values.
+//Values from the URL, i.e. PrettyMux path parameters and the query string,
+//are bound last, so they take precedence over the body.
+//Fields are bound by their 'form' tag, their 'json' tag, or their name, in
+//that order. Returns ValidationErrors if any field could not be converted or
+//is invalid (see Validate), and other errors if the body can't be read.
+func (r *Request) Bind(v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Bind: %T is not a pointer to a struct", v)
+	}
+
+	media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var errs ValidationErrors
+
+	//errors name fields the way the client sent them
+	tag := "form"
+
+	switch media_type {
+	case "application/json":
+		tag = "json"
+
+		//an empty body is allowed, since fields can come from r.Values
+		if err := decodeJSON(r.Body, v, true); err != nil && err != ErrEmptyRequest {
+			return err
+		}
+
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return r.formError(err)
+		}
+		errs = bindValues(value.Elem(), r.PostForm, "", errs)
+
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(BIND_MAX_MEMORY); err != nil {
+			return r.formError(err)
+		}
+		errs = bindValues(value.Elem(), url.Values(r.MultipartForm.Value), "", errs)
+	}
+
+	errs = bindValues(value.Elem(), r.Values, "", errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return validate(value.Elem(), tag)
+}
+
+//returns ErrBodyTooLarge if the form couldn't be parsed because of the body
+//limit, and describes other errors as an invalid form
+func (r *Request) formError(err error) error {
+	if r.bodyTooLarge() {
+		return ErrBodyTooLarge
+	}
+
+	return NewHTTPError(http.StatusBadRequest, "Invalid form", err)
+}
+
+//returns the name of a struct field in requests, or "" if the field is not
+//bound
+func fieldName(field reflect.StructField, tag string) string {
+	if len(field.PkgPath) > 0 {
+		//unexported
+		return ""
+	}
+
+	for _, key := range []string{tag, "json"} {
+		if len(key) == 0 {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get(key), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		if len(name) > 0 {
+			return name
+		}
+	}
+
+	return field.Name
+}
+
+//sets the fields of a struct from values
+func bindValues(value reflect.Value, values url.Values, prefix string, errs ValidationErrors) ValidationErrors {
+	t := value.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		//embedded structs are bound as if their fields belonged to the parent
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			errs = bindValues(value.Field(i), values, prefix, errs)
+			continue
+		}
+
+		name := fieldName(field, "form")
+		if len(name) == 0 {
+			continue
+		}
+
+		v, ok := values[name]
+		if !ok || len(v) == 0 {
+			continue
+		}
+
+		if err := setField(value.Field(i), v); err != nil {
+			errs = append(errs, FieldError{Field: prefix + name, Rule: "type", Message: err.Error()})
+		}
+	}
+
+	return errs
+}
+
+//converts values to the type of the field. Slices get all values, other
+//types get the first one.
+func setField(field reflect.Value, values []string) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(field.Type().Elem())
+		if err := setField(elem.Elem(), values); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+
+	case reflect.Slice:
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setField(slice.Index(i), []string{v}); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	s := values[0]
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		field.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive integer")
+		}
+		field.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(n)
+
+	default:
+		return fmt.Errorf("can't be set from a request (%s)", field.Type())
+	}
+
+	return nil
+}
+
+//Checks the 'validate' tags of the struct that v points to. Rules are
+//separated by commas:
+//	required   the field can't be empty, zero or nil
+//	email      the field must be an email address
+//	min=n      strings and slices must have at least n elements, numbers
+//	           must be at least n
+//	max=n      like min, but the upper bound
+//	len=n      strings and slices must have exactly n elements
+//	oneof=a b  the field must be one of the values separated by spaces
+//Empty fields are only checked by 'required'. Nested structs are checked
+//unless they are nil pointers, so optional ones should be pointers; a
+//'required' struct can't be the zero value. Fields are named by their JSON
+//names (Bind names them by the tag it bound them with), and fields of nested
+//structs are named parent.field. Returns ValidationErrors, or an error if a
+//tag is invalid.
+func Validate(v interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return fmt.Errorf("Validate: %T is not a struct", v)
+	}
+
+	return validate(value, "")
+}
+
+//validates a struct, naming its fields by tag, or by their JSON names
+func validate(value reflect.Value, tag string) error {
+	errs, err := validateStruct(value, "", tag, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func validateStruct(value reflect.Value, prefix, tag string, errs ValidationErrors) (ValidationErrors, error) {
+	t := value.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := value.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			var err error
+			if errs, err = validateStruct(fv, prefix, tag, errs); err != nil {
+				return errs, err
+			}
+			continue
+		}
+
+		name := fieldName(field, tag)
+		if len(name) == 0 {
+			continue
+		}
+
+		rules := field.Tag.Get("validate")
+
+		if len(rules) > 0 {
+			e, err := validateField(fv, prefix+name, rules)
+			if err != nil {
+				return errs, err
+			}
+			if e != nil {
+				errs = append(errs, *e)
+				continue
+			}
+		}
+
+		//nil pointers to nested structs are optional
+		nested := reflect.Indirect(fv)
+		if nested.Kind() == reflect.Struct && nested.Type().NumField() > 0 {
+			var err error
+			if errs, err = validateStruct(nested, prefix+name+".", tag, errs); err != nil {
+				return errs, err
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+//checks a field against its rules, and returns the first rule that fails
+func validateField(field reflect.Value, name, tag string) (*FieldError, error) {
+	for _, rule := range strings.Split(tag, ",") {
+		rule = strings.TrimSpace(rule)
+		arg := ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+
+		if rule == "required" {
+			if isEmptyValue(field) {
+				return &FieldError{Field: name, Rule: rule, Message: "is required"}, nil
+			}
+			continue
+		}
+
+		if isEmptyValue(field) {
+			continue
+		}
+
+		message, err := checkRule(reflect.Indirect(field), rule, arg)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %s", name, err)
+		}
+
+		if len(message) > 0 {
+			return &FieldError{Field: name, Rule: rule, Message: message}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+//returns a message if the value breaks the rule
+func checkRule(value reflect.Value, rule, arg string) (string, error) {
+	switch rule {
+	case "email":
+		if value.Kind() != reflect.String {
+			return "", fmt.Errorf("'email' only applies to strings")
+		}
+		if !emailRegexp.MatchString(value.String()) {
+			return "must be a valid email address", nil
+		}
+
+	case "min", "max", "len":
+		bound, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid '%s' argument '%s'", rule, arg)
+		}
+
+		n, is_length, err := measure(value)
+		if err != nil {
+			return "", fmt.Errorf("'%s' %s", rule, err)
+		}
+
+		unit := ""
+		if is_length {
+			unit = " characters"
+			if value.Kind() != reflect.String {
+				unit = " items"
+			}
+		}
+
+		switch {
+		case rule == "min" && n < bound:
+			return "must be at least " + arg + unit, nil
+		case rule == "max" && n > bound:
+			return "must be at most " + arg + unit, nil
+		case rule == "len" && n != bound:
+			return "must be exactly " + arg + unit, nil
+		}
+
+	case "oneof":
+		options := strings.Fields(arg)
+		actual := fmt.Sprint(value.Interface())
+		for _, option := range options {
+			if option == actual {
+				return "", nil
+			}
+		}
+		return "must be one of: " + strings.Join(options, ", "), nil
+
+	default:
+		return "", fmt.Errorf("unknown validation rule '%s'", rule)
+	}
+
+	return "", nil
+}
+
+//returns the length of strings and slices, or the value of numbers
+func measure(value reflect.Value) (n float64, is_length bool, err error) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true, nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(value.Len()), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), false, nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, nil
+	}
+
+	return 0, false, fmt.Errorf("does not apply to %s", value.Type())
+}
+
+//checks whether a value is the zero value of its type, or an empty
+//string, slice or map
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Struct:
+		return v.IsZero()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+
+	return false
+}
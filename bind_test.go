@@ -0,0 +1,281 @@
+package perfect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type bindAddress struct {
+	City string `json:"city" validate:"required"`
+	Zip  string `json:"zip" validate:"len=5"`
+}
+
+type bindUser struct {
+	Id       int          `json:"id"`
+	Username string       `json:"username" validate:"required,min=3,max=16"`
+	Password string       `json:"password" validate:"required,min=8"`
+	Email    string       `json:"email" validate:"required,email"`
+	Role     string       `json:"role" validate:"oneof=admin user"`
+	Age      *int         `json:"age" validate:"min=13"`
+	Tags     []string     `json:"tags" form:"tag" validate:"max=2"`
+	Address  *bindAddress `json:"address"`
+	Internal string       `json:"-"`
+	secret   string
+}
+
+func TestRequest_Bind(t *testing.T) {
+	age := 30
+
+	tests := []struct {
+		Name, ContentType, Body, Path string
+		Params                        []string
+		Expected                      bindUser
+	}{
+		{
+			"json", "application/json; charset=utf-8",
+			`{"username":"bob","password":"password1","email":"bob@example.com","age":30,"address":{"city":"Boston","zip":"02115"}}`,
+			"/users/7?role=admin", []string{"id", "7"},
+			bindUser{Id: 7, Username: "bob", Password: "password1", Email: "bob@example.com", Role: "admin", Age: &age, Address: &bindAddress{"Boston", "02115"}},
+		},
+		{
+			"form", "application/x-www-form-urlencoded",
+			"username=bob&password=password1&email=bob%40example.com&age=30&tag=a&tag=b&Internal=x&secret=x",
+			"/users", nil,
+			bindUser{Username: "bob", Password: "password1", Email: "bob@example.com", Age: &age, Tags: []string{"a", "b"}},
+		},
+		{
+			"query", "",
+			"",
+			"/users?username=bob&password=password1&email=bob@example.com&id=3", nil,
+			bindUser{Id: 3, Username: "bob", Password: "password1", Email: "bob@example.com"},
+		},
+		{
+			//path parameters take precedence over the body
+			"precedence", "application/json",
+			`{"id":1,"username":"bob","password":"password1","email":"bob@example.com"}`,
+			"/users/7", []string{"id", "7"},
+			bindUser{Id: 7, Username: "bob", Password: "password1", Email: "bob@example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "http://localhost"+test.Path, strings.NewReader(test.Body))
+		if len(test.ContentType) > 0 {
+			request.Header.Set("Content-Type", test.ContentType)
+		}
+
+		r := NewRequest(request, request.URL.Path, &Module{})
+		for i := 0; i < len(test.Params); i += 2 {
+			r.Values[test.Params[i]] = append([]string{test.Params[i+1]}, r.Values[test.Params[i]]...)
+		}
+
+		user := bindUser{}
+		if err := r.Bind(&user); err != nil {
+			t.Errorf("%v: err = %v", test.Name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(user, test.Expected) {
+			t.Errorf("%v: user = %#v, expected %#v", test.Name, user, test.Expected)
+		}
+	}
+}
+
+func TestRequest_BindMultipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("username", "bob")
+	form.WriteField("password", "password1")
+	form.WriteField("email", "bob@example.com")
+	form.Close()
+
+	request, _ := http.NewRequest("POST", "http://localhost/users", body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+
+	user := bindUser{}
+	if err := NewRequest(request, "/users", &Module{}).Bind(&user); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if user.Username != "bob" || user.Email != "bob@example.com" {
+		t.Errorf("user = %#v", user)
+	}
+}
+
+func TestRequest_BindErrors(t *testing.T) {
+	body := `{"username":"bo","password":"short","email":"bob","role":"root","age":12,"tags":["a","b","c"],"address":{"zip":"123"}}`
+
+	request, _ := http.NewRequest("POST", "http://localhost/users?id=abc", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+
+	user := bindUser{}
+	err := NewRequest(request, "/users", &Module{}).Bind(&user)
+
+	//conversion errors are reported before validation
+	expected := ValidationErrors{{Field: "id", Rule: "type", Message: "must be an integer"}}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("err = %#v, expected %#v", err, expected)
+	}
+
+	err = Validate(&user)
+
+	expected = ValidationErrors{
+		{Field: "username", Rule: "min", Message: "must be at least 3 characters"},
+		{Field: "password", Rule: "min", Message: "must be at least 8 characters"},
+		{Field: "email", Rule: "email", Message: "must be a valid email address"},
+		{Field: "role", Rule: "oneof", Message: "must be one of: admin, user"},
+		{Field: "age", Rule: "min", Message: "must be at least 13"},
+		{Field: "tags", Rule: "max", Message: "must be at most 2 items"},
+		{Field: "address.city", Rule: "required", Message: "is required"},
+		{Field: "address.zip", Rule: "len", Message: "must be exactly 5 characters"},
+	}
+
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("err = %#v, expected %#v", err, expected)
+	}
+
+	if status := ErrorStatus(err); status != http.StatusBadRequest {
+		t.Errorf("status = %v, expected %v", status, http.StatusBadRequest)
+	}
+
+	//validation errors can be sent to the client as is
+	response := httptest.NewRecorder()
+	JSONResult(response, &Request{}, false, err)
+
+	result := struct {
+		Success bool         `json:"success"`
+		Message []FieldError `json:"message"`
+	}{}
+
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil || len(result.Message) != len(expected) {
+		t.Errorf("body = %s, err = %v", response.Body.String(), err)
+	}
+
+	//invalid JSON
+	request, _ = http.NewRequest("POST", "http://localhost/users", strings.NewReader(`{"username":`))
+	request.Header.Set("Content-Type", "application/json")
+
+	err = NewRequest(request, "/users", &Module{}).Bind(&user)
+	if ErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("err = %v, expected a 400 Bad Request", err)
+	}
+}
+
+func TestValidate_InvalidRules(t *testing.T) {
+	tests := []interface{}{
+		&struct {
+			Name string `validate:"unknown"`
+		}{"x"},
+		&struct {
+			Name string `validate:"min=abc"`
+		}{"x"},
+		&struct {
+			Count int `validate:"email"`
+		}{1},
+		"not a struct",
+	}
+
+	for _, test := range tests {
+		err := Validate(test)
+
+		var errs ValidationErrors
+		if err == nil || errors.As(err, &errs) {
+			t.Errorf("%#v: err = %v, expected an error", test, err)
+		}
+	}
+}
+
+type bindStreet struct {
+	Street string `json:"street" validate:"required"`
+}
+
+type bindContact struct {
+	Name     string      `json:"name"`
+	Address  bindStreet  `json:"address" validate:"required"`
+	Billing  bindStreet  `json:"billing"`
+	Shipping *bindStreet `json:"shipping"`
+}
+
+func TestValidate_NestedStructs(t *testing.T) {
+	tests := []struct {
+		Body     string
+		Expected ValidationErrors
+	}{
+		{`{"name":"a","address":{"street":"x"},"billing":{"street":"y"}}`, nil},
+		//required structs can't be empty
+		{`{"name":"a","billing":{"street":"y"}}`, ValidationErrors{
+			{Field: "address", Rule: "required", Message: "is required"},
+		}},
+		{`{"name":"a","address":{},"billing":{"street":"y"}}`, ValidationErrors{
+			{Field: "address", Rule: "required", Message: "is required"},
+		}},
+		//other structs are always validated
+		{`{"name":"a","address":{"street":"x"}}`, ValidationErrors{
+			{Field: "billing.street", Rule: "required", Message: "is required"},
+		}},
+		{`{"name":"a","address":{"street":"x"},"billing":{}}`, ValidationErrors{
+			{Field: "billing.street", Rule: "required", Message: "is required"},
+		}},
+		//unless they are nil pointers
+		{`{"name":"a","address":{"street":"x"},"billing":{"street":"y"},"shipping":{}}`, ValidationErrors{
+			{Field: "shipping.street", Rule: "required", Message: "is required"},
+		}},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "http://localhost/contacts", strings.NewReader(test.Body))
+		request.Header.Set("Content-Type", "application/json")
+
+		contact := bindContact{}
+		err := NewRequest(request, "/contacts", &Module{}).Bind(&contact)
+
+		if test.Expected == nil && err != nil || test.Expected != nil && !reflect.DeepEqual(err, test.Expected) {
+			t.Errorf("%v: err = %#v, expected %#v", test.Body, err, test.Expected)
+		}
+	}
+}
+
+func TestRequest_BindErrorNames(t *testing.T) {
+	type signup struct {
+		Login string   `form:"user_login" json:"login" validate:"required,min=3"`
+		Tags  []string `form:"tag" json:"tags" validate:"max=1"`
+	}
+
+	tests := []struct {
+		ContentType, Body string
+		Expected          ValidationErrors
+	}{
+		//errors name fields the way the client sent them
+		{"application/x-www-form-urlencoded", "user_login=ab&tag=a&tag=b", ValidationErrors{
+			{Field: "user_login", Rule: "min", Message: "must be at least 3 characters"},
+			{Field: "tag", Rule: "max", Message: "must be at most 1 items"},
+		}},
+		{"", "", ValidationErrors{
+			{Field: "user_login", Rule: "required", Message: "is required"},
+		}},
+		{"application/json", `{"login":"ab","tags":["a","b"]}`, ValidationErrors{
+			{Field: "login", Rule: "min", Message: "must be at least 3 characters"},
+			{Field: "tags", Rule: "max", Message: "must be at most 1 items"},
+		}},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "http://localhost/signup", strings.NewReader(test.Body))
+		if len(test.ContentType) > 0 {
+			request.Header.Set("Content-Type", test.ContentType)
+		}
+
+		err := NewRequest(request, "/signup", &Module{}).Bind(&signup{})
+
+		if !reflect.DeepEqual(err, test.Expected) {
+			t.Errorf("%v %v: err = %#v, expected %#v", test.ContentType, test.Body, err, test.Expected)
+		}
+	}
+}
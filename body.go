@@ -0,0 +1,128 @@
+package perfect
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	//the default limit of request bodies, in bytes
+	MAX_BODY_SIZE = 10 << 20
+)
+
+//A request body that can't be read past a limit. Unlike http.MaxBytesReader,
+//the limit can change until the body is read, so that routes can have their
+//own limits.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64 //negative for no limit
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+
+	if b.limit < 0 {
+		return b.ReadCloser.Read(p)
+	}
+
+	//read one more byte than allowed, to find out if the limit was exceeded
+	if left := b.limit - b.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	if b.read > b.limit {
+		b.exceeded = true
+		return n - int(b.read-b.limit), ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+//returns the body limit of a module
+func (m *Module) maxBodySize() int64 {
+	if m == nil || m.MaxBodySize == 0 {
+		return MAX_BODY_SIZE
+	}
+
+	return m.MaxBodySize
+}
+
+//limits the body of the request to the module's MaxBodySize
+func (r *Request) limitBody() {
+	if r.Request.Body == nil || r.Request.Body == http.NoBody {
+		return
+	}
+
+	r.body = &limitedBody{
+		ReadCloser: r.Request.Body,
+		limit:      r.Module.maxBodySize(),
+	}
+	r.Request.Body = r.body
+}
+
+//Sets the body limit of the request, in bytes. A negative limit removes it.
+//Returns ErrBodyTooLarge if the request says its body is larger, i.e.
+//through its Content-Length.
+func (r *Request) SetBodyLimit(limit int64) error {
+	if limit >= 0 && r.ContentLength > limit {
+		return ErrBodyTooLarge
+	}
+
+	if r.body != nil {
+		r.body.limit = limit
+	}
+
+	return nil
+}
+
+//checks whether the body was larger than its limit
+func (r *Request) bodyTooLarge() bool {
+	return r.body != nil && r.body.exceeded
+}
+
+//Returns middleware that sets the body limit of a route or group, i.e.
+//	module.Post("/upload", perfect.BodyLimit(100<<20)(handler))
+//Requests with larger bodies receive 413 Request Entity Too Large.
+func BodyLimit(limit int64) Middleware {
+	return func(handler RequestHandler) RequestHandler {
+		return func(w http.ResponseWriter, r *Request) {
+			if err := r.SetBodyLimit(limit); err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			handler(w, r)
+		}
+	}
+}
+
+//Returns the whole body of the request, i.e. to verify its signature. The
+//body can still be parsed afterwards, with ParseJSON or Bind.
+func (r *Request) RawBody() ([]byte, error) {
+	if r.rawBody != nil {
+		return r.rawBody, nil
+	}
+
+	if r.Request.Body == nil {
+		return []byte{}, nil
+	}
+
+	data, err := ioutil.ReadAll(r.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.rawBody = data
+	r.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	return data, nil
+}
@@ -0,0 +1,154 @@
+package perfect
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//a body that never ends
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+//returns a module that parses the JSON body of /json and /loose, and binds /form
+func newBodyTestModule(max_body_size int64) *Module {
+	module := &Module{Name: "body", Mux: NewPrettyMux(), MaxBodySize: max_body_size}
+
+	parse := func(w http.ResponseWriter, r *Request) {
+		var data map[string]string
+		if err := r.ParseJSON(&data); err != nil {
+			Error(w, r, err)
+			return
+		}
+		w.Write([]byte(data["name"]))
+	}
+
+	module.Post("/json", parse)
+	module.Post("/loose", func(w http.ResponseWriter, r *Request) {
+		var data map[string]string
+		if err := r.ParseLooseJSON(&data); err != nil {
+			Error(w, r, err)
+			return
+		}
+		w.Write([]byte(data["name"]))
+	})
+	module.Post("/upload", BodyLimit(64)(parse))
+	module.Post("/unlimited", BodyLimit(-1)(parse))
+	module.Post("/form", func(w http.ResponseWriter, r *Request) {
+		form := &struct {
+			Name string `form:"name"`
+		}{}
+		if err := r.Bind(form); err != nil {
+			Error(w, r, err)
+			return
+		}
+		w.Write([]byte(form.Name))
+	})
+
+	return module
+}
+
+func TestBodyLimit(t *testing.T) {
+	module := newBodyTestModule(32)
+
+	long := strings.Repeat("x", 40)
+
+	tests := []struct {
+		Path, ContentType, Body string
+		Status                  int
+		Result                  string
+	}{
+		{"/json", "application/json", `{"name":"bob"}`, http.StatusOK, "bob"},
+		{"/json", "application/json", `{"name":"` + long + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"/json", "application/json", `{"name":"bob"} {}`, http.StatusBadRequest, ""},
+		{"/json", "application/json", `{"name":"bob"}xyz`, http.StatusBadRequest, ""},
+		{"/json", "application/json", `{"name":`, http.StatusBadRequest, ""},
+		{"/loose", "application/json", `{"name":"bob"}xyz`, http.StatusOK, "bob"},
+		{"/json", "application/json", ``, http.StatusBadRequest, ""},
+		{"/upload", "application/json", `{"name":"` + long + `"}`, http.StatusOK, long},
+		{"/upload", "application/json", `{"name":"` + long + long + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"/unlimited", "application/json", `{"name":"` + long + long + `"}`, http.StatusOK, long + long},
+		{"/form", "application/x-www-form-urlencoded", url.Values{"name": {"bob"}}.Encode(), http.StatusOK, "bob"},
+		{"/form", "application/x-www-form-urlencoded", url.Values{"name": {long}}.Encode(), http.StatusRequestEntityTooLarge, ""},
+		{"/form", "application/json", `{"name":"` + long + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"/form", "application/json", `{"name":"bob"} {}`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "http://localhost"+test.Path, strings.NewReader(test.Body))
+		request.Header.Set("Content-Type", test.ContentType)
+		//the limit must hold even if the client doesn't say how long the body is
+		request.ContentLength = -1
+
+		response := httptest.NewRecorder()
+		module.Route(response, NewRequest(request, test.Path, module))
+
+		if response.Code != test.Status {
+			t.Errorf("%v %v: status = %v, expected %v (%v)", test.Path, test.Body, response.Code, test.Status, response.Body.String())
+		}
+
+		if test.Status == http.StatusOK && response.Body.String() != test.Result {
+			t.Errorf("%v %v: body = %v, expected %v", test.Path, test.Body, response.Body.String(), test.Result)
+		}
+	}
+}
+
+func TestBodyLimit_ContentLength(t *testing.T) {
+	module := newBodyTestModule(0)
+
+	request, _ := http.NewRequest("POST", "http://localhost/upload", strings.NewReader(strings.Repeat("x", 100)))
+
+	response := httptest.NewRecorder()
+	module.Route(response, NewRequest(request, "/upload", module))
+
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %v, expected %v", response.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestRequest_ParseJSON_Stream(t *testing.T) {
+	body := io.MultiReader(strings.NewReader(`{"name":"bob"}`), endlessReader{})
+
+	request, _ := http.NewRequest("POST", "http://localhost/", body)
+	r := NewRequest(request, "/", &Module{MaxBodySize: -1})
+
+	//the value is decoded without reading the rest of the body
+	var data map[string]string
+	if err := r.ParseLooseJSON(&data); err != nil || data["name"] != "bob" {
+		t.Errorf("data = %v, err = %v", data, err)
+	}
+}
+
+func TestRequest_RawBody(t *testing.T) {
+	request, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader(`{"name":"bob"}`))
+	r := NewRequest(request, "/", &Module{})
+
+	for i := 0; i < 2; i++ {
+		if data, err := r.RawBody(); err != nil || string(data) != `{"name":"bob"}` {
+			t.Errorf("data = %s, err = %v", data, err)
+		}
+	}
+
+	//the body can still be parsed
+	var data map[string]string
+	if err := r.ParseJSON(&data); err != nil || data["name"] != "bob" {
+		t.Errorf("data = %v, err = %v", data, err)
+	}
+
+	//and it's still limited
+	request, _ = http.NewRequest("POST", "http://localhost/", strings.NewReader(`{"name":"bob"}`))
+	r = NewRequest(request, "/", &Module{MaxBodySize: 4})
+
+	if _, err := r.RawBody(); err != ErrBodyTooLarge {
+		t.Errorf("err = %v, expected %v", err, ErrBodyTooLarge)
+	}
+}
@@ -0,0 +1,332 @@
+package perfect
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	//responses smaller than this are not compressed
+	COMPRESS_MIN_SIZE = 1024
+)
+
+//content types that are already compressed, or that must be sent as they
+//are written
+var compressSkipTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-brotli",
+	"application/octet-stream",
+	"application/pdf",
+	"text/event-stream",
+}
+
+//Compresses responses with gzip or deflate, depending on Accept-Encoding.
+//Small responses, range requests, responses that are already compressed
+//(i.e. precompressed static files, images) and event streams are sent as
+//they are. Compressed responses only keep a weak ETag.
+type Compressor struct {
+	Level   int
+	MinSize int
+
+	gzipPool sync.Pool
+	zlibPool sync.Pool
+}
+
+//returns a compressor that uses a compression level from compress/flate.
+//Panics if the level is invalid.
+func NewCompressor(level int) *Compressor {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		panic(fmt.Errorf("invalid compression level %d", level))
+	}
+
+	c := &Compressor{
+		Level:   level,
+		MinSize: COMPRESS_MIN_SIZE,
+	}
+
+	c.gzipPool.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, c.Level)
+		return w
+	}
+
+	//deflate is the zlib format, not a raw deflate stream (RFC 9110)
+	c.zlibPool.New = func() interface{} {
+		w, _ := zlib.NewWriterLevel(nil, c.Level)
+		return w
+	}
+
+	return c
+}
+
+//Returns middleware that compresses responses, i.e.
+//	module.Use(perfect.Compress(gzip.DefaultCompression))
+func Compress(level int) Middleware {
+	return NewCompressor(level).Middleware
+}
+
+//a compressing writer that can be reused
+type resetWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+//wraps handler, so that its responses are compressed
+func (c *Compressor) Middleware(handler RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		addVary(w.Header(), "Accept-Encoding")
+
+		encoding := ""
+		switch {
+		case r.Method == "HEAD" || len(r.Header.Get("Range")) > 0:
+		case acceptsEncoding(r.Request, "gzip"):
+			encoding = "gzip"
+		case acceptsEncoding(r.Request, "deflate"):
+			encoding = "deflate"
+		}
+
+		if len(encoding) == 0 {
+			handler(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       encoding,
+			status:         http.StatusOK,
+		}
+		defer func() {
+			//let the module mux send the error page uncompressed
+			if r_err := recover(); r_err != nil {
+				cw.abort()
+				panic(r_err)
+			}
+			cw.close()
+		}()
+
+		handler(cw, r)
+	}
+}
+
+//adds a value to the Vary header, unless it's already there
+func addVary(header http.Header, value string) {
+	if headerContains(header, "Vary", value) {
+		return
+	}
+
+	header.Add("Vary", value)
+}
+
+//buffers the start of a response, to decide whether it's worth compressing
+type compressResponseWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	encoding   string
+
+	status      int
+	wroteHeader bool //WriteHeader was called by the handler
+	decided     bool
+	buf         []byte
+	writer      resetWriter
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.status = status
+	cw.wroteHeader = true
+
+	//responses without a body are never compressed
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+
+		if len(cw.buf) < cw.compressor.MinSize {
+			return len(p), nil
+		}
+
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	if cw.writer != nil {
+		return cw.writer.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+//checks whether the response can be compressed
+func (cw *compressResponseWriter) compressible() bool {
+	header := cw.ResponseWriter.Header()
+
+	if len(header.Get("Content-Encoding")) > 0 || cw.status == http.StatusPartialContent {
+		return false
+	}
+
+	content_type := header.Get("Content-Type")
+	if len(content_type) == 0 {
+		//sniff the type now, since it can't be sniffed once it's compressed
+		content_type = http.DetectContentType(cw.buf)
+		header.Set("Content-Type", content_type)
+	}
+
+	content_type = strings.ToLower(content_type)
+
+	if strings.HasPrefix(content_type, "image/svg+xml") {
+		return true
+	}
+
+	for _, skip := range compressSkipTypes {
+		if strings.HasPrefix(content_type, skip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//sends the headers and the buffered data, compressed if compress is true
+//and the response can be compressed
+func (cw *compressResponseWriter) decide(compress bool) error {
+	cw.decided = true
+
+	if len(cw.buf) > 0 || cw.wroteHeader {
+		compress = compress && cw.compressible()
+	} else {
+		compress = false
+	}
+
+	if compress {
+		header := cw.ResponseWriter.Header()
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+
+		//the compressed bytes differ from the ones the strong ETag was
+		//computed for, so it can only be a weak validator
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		if cw.encoding == "gzip" {
+			cw.writer = cw.compressor.gzipPool.Get().(*gzip.Writer)
+		} else {
+			cw.writer = cw.compressor.zlibPool.Get().(*zlib.Writer)
+		}
+		cw.writer.Reset(cw.ResponseWriter)
+	}
+
+	//otherwise, the first write sends the headers (and sniffs the type)
+	if cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+
+	var err error
+	if cw.writer != nil {
+		_, err = cw.writer.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+//sends everything written so far. Responses that are flushed before they
+//reach the minimum size are not compressed.
+func (cw *compressResponseWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.compressor.MinSize)
+	}
+
+	if cw.writer != nil {
+		cw.writer.Flush()
+	}
+
+	if flusher := findFlusher(cw.ResponseWriter); flusher != nil {
+		flusher.Flush()
+	}
+}
+
+//lets handlers take over the connection, i.e. for WebSockets
+func (cw *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker := findHijacker(cw.ResponseWriter)
+	if hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+
+	//nothing must be written after the connection has been taken over
+	cw.decided = true
+
+	return hijacker.Hijack()
+}
+
+//returns the original writer
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+//discards the buffered response, i.e. after a panic
+func (cw *compressResponseWriter) abort() {
+	cw.decided = true
+	cw.buf = nil
+	cw.release()
+}
+
+//sends the rest of the response, and returns the compressor to its pool
+func (cw *compressResponseWriter) close() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.compressor.MinSize)
+	}
+
+	if cw.writer == nil {
+		return
+	}
+
+	cw.writer.Close()
+	cw.release()
+}
+
+//returns the compressor to its pool
+func (cw *compressResponseWriter) release() {
+	switch w := cw.writer.(type) {
+	case *gzip.Writer:
+		cw.compressor.gzipPool.Put(w)
+	case *zlib.Writer:
+		cw.compressor.zlibPool.Put(w)
+	}
+
+	cw.writer = nil
+}
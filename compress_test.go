@@ -0,0 +1,253 @@
+package perfect
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//returns the decompressed body of a response
+func decompress(t *testing.T, response *httptest.ResponseRecorder) string {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch response.Header().Get("Content-Encoding") {
+	case "gzip":
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+		data, err = ioutil.ReadAll(reader)
+	case "deflate":
+		reader, err := zlib.NewReader(response.Body)
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+		data, err = ioutil.ReadAll(reader)
+	default:
+		data = response.Body.Bytes()
+	}
+
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	return string(data)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("perfect ", 500)
+
+	module := &Module{Name: "compress", Mux: NewPrettyMux()}
+	module.Use(Compress(gzip.DefaultCompression))
+
+	module.Get("/large", func(w http.ResponseWriter, r *Request) {
+		//written in small pieces
+		for i := 0; i < 500; i++ {
+			w.Write([]byte("perfect "))
+		}
+	})
+	module.Get("/small", func(w http.ResponseWriter, r *Request) {
+		JSONResult(w, r, true, "ok")
+	})
+	module.Get("/image", func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(large))
+	})
+	module.Get("/svg", func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(large))
+	})
+	module.Get("/encoded", func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte(large))
+	})
+	module.Get("/created", func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "4000")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(large))
+	})
+	module.Get("/empty", func(w http.ResponseWriter, r *Request) {
+		NoContent(w)
+	})
+	module.Get("/events", func(w http.ResponseWriter, r *Request) {
+		stream, err := r.EventStream(w)
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+		defer stream.Close()
+		stream.Send(&Event{Data: large})
+	})
+
+	tests := []struct {
+		Path, AcceptEncoding, Range, Encoding string
+		Status                                int
+		ContentType                           string
+	}{
+		{"/large", "gzip, deflate", "", "gzip", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/large", "deflate", "", "deflate", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/large", "gzip;q=0, deflate", "", "deflate", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/large", "", "", "", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/large", "br", "", "", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/large", "gzip", "bytes=0-10", "", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/small", "gzip", "", "", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/image", "gzip", "", "", http.StatusOK, "image/png"},
+		{"/svg", "gzip", "", "gzip", http.StatusOK, "image/svg+xml"},
+		{"/encoded", "gzip", "", "br", http.StatusOK, "text/plain; charset=utf-8"},
+		{"/created", "gzip", "", "gzip", http.StatusCreated, "application/json"},
+		{"/empty", "gzip", "", "", http.StatusNoContent, ""},
+		{"/events", "gzip", "", "", http.StatusOK, "text/event-stream"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "http://localhost"+test.Path, nil)
+		request.Header.Set("Accept-Encoding", test.AcceptEncoding)
+		if len(test.Range) > 0 {
+			request.Header.Set("Range", test.Range)
+		}
+
+		response := httptest.NewRecorder()
+		module.Route(response, NewRequest(request, test.Path, module))
+
+		if response.Code != test.Status {
+			t.Errorf("%v (%v): status = %v, expected %v", test.Path, test.AcceptEncoding, response.Code, test.Status)
+		}
+
+		if encoding := response.Header().Get("Content-Encoding"); encoding != test.Encoding {
+			t.Errorf("%v (%v): Content-Encoding = %v, expected %v", test.Path, test.AcceptEncoding, encoding, test.Encoding)
+		}
+
+		if ct := response.Header().Get("Content-Type"); ct != test.ContentType {
+			t.Errorf("%v (%v): Content-Type = %v, expected %v", test.Path, test.AcceptEncoding, ct, test.ContentType)
+		}
+
+		if vary := response.Header()["Vary"]; len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%v (%v): Vary = %v", test.Path, test.AcceptEncoding, vary)
+		}
+
+		if test.Encoding == "gzip" || test.Encoding == "deflate" {
+			if len(response.Header().Get("Content-Length")) > 0 {
+				t.Errorf("%v (%v): Content-Length = %v", test.Path, test.AcceptEncoding, response.Header().Get("Content-Length"))
+			}
+
+			if body := decompress(t, response); body != large {
+				t.Errorf("%v (%v): body has %v bytes, expected %v", test.Path, test.AcceptEncoding, len(body), len(large))
+			}
+		}
+	}
+}
+
+func TestCompress_StaticFiles(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	module.Use(Compress(gzip.BestSpeed))
+
+	//precompressed variants are sent as they are
+	w := getStatic(module, "/static/app.js", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.String() != "gzipped app" {
+		t.Errorf("Content-Encoding = %v, body = %q", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+
+	if vary := w.Header()["Vary"]; len(vary) != 1 {
+		t.Errorf("Vary = %v", vary)
+	}
+
+	//files compressed on the fly get a weak ETag
+	large := strings.Repeat("body { margin: 0; }\n", 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "static", "large.css"), []byte(large), 0644); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	plain := getStatic(module, "/static/large.css", nil)
+	etag := plain.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("ETag = %v, expected a strong ETag", etag)
+	}
+
+	w = getStatic(module, "/static/large.css", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != "W/"+etag {
+		t.Errorf("Content-Encoding = %v, ETag = %v, expected gzip, W/%v", w.Header().Get("Content-Encoding"), w.Header().Get("ETag"), etag)
+	}
+
+	//the weak ETag still validates the cached copy
+	w = getStatic(module, "/static/large.css", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "W/" + etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status = %v, expected %v", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestCompress_Panic(t *testing.T) {
+	mux := NewModuleMux()
+
+	module := &Module{Name: "compress", Mux: NewHTTPMux()}
+	module.Use(Compress(gzip.DefaultCompression))
+	module.Get("/panic", func(w http.ResponseWriter, r *Request) {
+		w.Write([]byte("partial"))
+		panic("boom")
+	})
+	mux.Mount(module, "/")
+
+	request, _ := http.NewRequest("GET", "http://localhost/panic", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+
+	if response.Code != http.StatusInternalServerError || response.Body.String() != "Internal Server Error\n" {
+		t.Errorf("status = %v, body = %q", response.Code, response.Body.String())
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	body := bytes.Repeat([]byte("perfect "), 1000)
+	handler := Compress(gzip.DefaultCompression)(func(w http.ResponseWriter, r *Request) {
+		w.Write(body)
+	})
+
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	r := NewRequest(request, "/", &Module{})
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		handler(httptest.NewRecorder(), r)
+	}
+}
+
+func TestCompress_WebSocket(t *testing.T) {
+	module := &Module{Name: "ws", Mux: NewPrettyMux()}
+	module.Use(Compress(gzip.DefaultCompression))
+	module.WebSocket("/echo", func(ws *WebSocket, r *Request) {
+		ws.WriteText("hello")
+		ws.Close(WS_CLOSE_NORMAL, "")
+	})
+
+	mux := NewModuleMux()
+	mux.Mount(module, "/")
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, response := dialWebSocket(t, server, "/echo", map[string]string{"Accept-Encoding": "gzip"})
+	defer client.conn.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols || len(response.Header.Get("Content-Encoding")) > 0 {
+		t.Fatalf("status = %v, header = %v", response.StatusCode, response.Header)
+	}
+
+	if opcode, payload := client.readFrame(); opcode != wsText || string(payload) != "hello" {
+		t.Errorf("opcode = %v, payload = %q", opcode, payload)
+	}
+}
@@ -0,0 +1,212 @@
+package perfect
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	//the request and response header with the CSRF token of XHR clients
+	CSRF_HEADER = "X-CSRF-Token"
+	//the form field with the CSRF token of HTML forms
+	CSRF_FIELD = "csrf_token"
+	//the session value that holds the CSRF secret
+	CSRF_SESSION_KEY = "csrf_secret"
+	//the size of the CSRF secret, in bytes
+	CSRF_SECRET_SIZE = 32
+)
+
+//Rejects state-changing requests (POST, PUT, DELETE, PATCH) that don't carry
+//a valid CSRF token, either in the X-CSRF-Token header or in the csrf_token
+//form field. Tokens are derived from a secret kept in the session; each
+//token is masked with a new random pad, so that it can't be recovered from
+//compressed responses (BREACH).
+//Templates get a token from the 'csrf' function, i.e.
+//	<input type="hidden" name="csrf_token" value="<% csrf %>">
+//and XHR clients receive one in the X-CSRF-Token response header.
+type CSRF struct {
+	Header string
+	Field  string
+
+	//module-relative paths that are not checked, i.e. APIs that use token
+	//authentication instead of cookies. Paths are matched with path.Match;
+	//a path that ends with '/' matches every path under it.
+	Exempt []string
+}
+
+//returns a CSRF checker with the default header and field names
+func NewCSRF(exempt ...string) *CSRF {
+	return &CSRF{
+		Header: CSRF_HEADER,
+		Field:  CSRF_FIELD,
+		Exempt: exempt,
+	}
+}
+
+//Returns middleware that rejects requests without a valid CSRF token, i.e.
+//	module.Use(perfect.CSRFProtect("/api/"))
+func CSRFProtect(exempt ...string) Middleware {
+	return NewCSRF(exempt...).Middleware
+}
+
+//wraps handler, so that unsafe requests must have a valid CSRF token
+func (c *CSRF) Middleware(handler RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		if !safeMethod(r.Method) && !c.exempt(r.URL.Path) {
+			valid, err := r.validCSRFToken(c.token(r))
+			if err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			if !valid {
+				Error(w, r, ErrInvalidCSRFToken)
+				return
+			}
+		}
+
+		//XHR clients read the token for their next request from the headers
+		if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+			token, err := issueCSRFToken(w, r)
+			if err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			w.Header().Set(c.Header, token)
+		}
+
+		handler(w, r)
+	}
+}
+
+//returns the token sent by the client, from the header or the form field
+func (c *CSRF) token(r *Request) string {
+	if token := r.Header.Get(c.Header); len(token) > 0 {
+		return token
+	}
+
+	//only parses the body of url-encoded and multipart forms
+	return r.Request.PostFormValue(c.Field)
+}
+
+//checks whether a module-relative path doesn't need a CSRF token
+func (c *CSRF) exempt(p string) bool {
+	for _, pattern := range c.Exempt {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(p, pattern) {
+				return true
+			}
+			continue
+		}
+
+		if matched, _ := path.Match(pattern, p); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+//checks whether an HTTP method must not change state
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+
+	return false
+}
+
+//returns the CSRF secret of the session, and creates one if it doesn't exist
+func (r *Request) csrfSecret(create bool) ([]byte, error) {
+	session, err := r.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Values == nil {
+		session.Values = &map[string]string{}
+	}
+
+	values := *session.Values
+
+	if secret, err := base64.RawURLEncoding.DecodeString(values[CSRF_SESSION_KEY]); err == nil && len(secret) == CSRF_SECRET_SIZE {
+		return secret, nil
+	}
+
+	if !create {
+		return nil, nil
+	}
+
+	secret := make([]byte, CSRF_SECRET_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	values[CSRF_SESSION_KEY] = base64.RawURLEncoding.EncodeToString(secret)
+
+	if err := r.Module.Db.Save(session); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+//Returns a CSRF token for the session of the request. Every call returns a
+//different token, but all of them stay valid for as long as the session.
+func (r *Request) CSRFToken() (string, error) {
+	secret, err := r.csrfSecret(true)
+	if err != nil {
+		return "", err
+	}
+
+	//the token is a random pad, followed by the secret XOR'ed with the pad
+	token := make([]byte, 2*CSRF_SECRET_SIZE)
+	if _, err := rand.Read(token[:CSRF_SECRET_SIZE]); err != nil {
+		return "", err
+	}
+
+	for i := 0; i < CSRF_SECRET_SIZE; i++ {
+		token[CSRF_SECRET_SIZE+i] = token[i] ^ secret[i]
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+//returns a CSRF token, and sends the session cookie if the session is new,
+//since the token is useless without it
+func issueCSRFToken(w http.ResponseWriter, r *Request) (string, error) {
+	token, err := r.CSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	r.sendSessionCookie(w)
+
+	return token, nil
+}
+
+//checks whether token was issued for the session of the request
+func (r *Request) validCSRFToken(token string) (bool, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != 2*CSRF_SECRET_SIZE {
+		return false, nil
+	}
+
+	secret, err := r.csrfSecret(false)
+	if err != nil || secret == nil {
+		return false, err
+	}
+
+	unmasked := make([]byte, CSRF_SECRET_SIZE)
+	for i := 0; i < CSRF_SECRET_SIZE; i++ {
+		unmasked[i] = data[i] ^ data[CSRF_SECRET_SIZE+i]
+	}
+
+	return subtle.ConstantTimeCompare(unmasked, secret) == 1, nil
+}
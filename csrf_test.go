@@ -0,0 +1,237 @@
+package perfect
+
+import (
+	"bytes"
+	"github.com/vpetrov/perfect/orm"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//a database that keeps sessions in memory
+type sessionDatabase struct {
+	orm.Database
+	sessions map[string]Session
+	ids      int
+}
+
+func newSessionDatabase() *sessionDatabase {
+	return &sessionDatabase{sessions: map[string]Session{}}
+}
+
+func (db *sessionDatabase) UniqueId() string {
+	db.ids++
+	return strconv.Itoa(db.ids)
+}
+
+func (db *sessionDatabase) Find(r orm.Record) error {
+	session := r.(*Session)
+
+	saved, ok := db.sessions[*session.Id]
+	if !ok {
+		return orm.ErrNotFound
+	}
+
+	values := map[string]string{}
+	for key, value := range *saved.Values {
+		values[key] = value
+	}
+
+	*session = saved
+	session.Values = &values
+
+	return nil
+}
+
+func (db *sessionDatabase) Save(r orm.Record) error {
+	session := r.(*Session)
+	db.sessions[*session.Id] = *session
+	return nil
+}
+
+//returns a module with a session database and CSRF protection
+func newCSRFTestModule(exempt ...string) *Module {
+	module := &Module{Name: "csrf", Mux: NewPrettyMux(), Db: newSessionDatabase()}
+	module.Use(CSRFProtect(exempt...))
+
+	ok := func(w http.ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	}
+
+	module.Get("/form", ok)
+	module.Post("/form", ok)
+	module.Put("/items/:id", ok)
+	module.Delete("/items/:id", ok)
+	module.Post("/api/hooks/github", ok)
+	module.Post("/webhook", ok)
+
+	return module
+}
+
+//sends a request to module, with the given session cookie and headers
+func csrfRequest(module *Module, method, path, session, content_type string, body string, header map[string]string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	if len(session) > 0 {
+		request.AddCookie(&http.Cookie{Name: SESSION_ID, Value: session})
+	}
+	if len(content_type) > 0 {
+		request.Header.Set("Content-Type", content_type)
+	}
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+
+	response := httptest.NewRecorder()
+	module.Route(response, NewRequest(request, path, module))
+
+	return response
+}
+
+//returns a token and the session it was issued for, from an XHR request
+func csrfToken(t *testing.T, module *Module) (token, session string) {
+	db := module.Db.(*sessionDatabase)
+	before := len(db.sessions)
+
+	response := csrfRequest(module, "GET", "/form", "", "", "", map[string]string{"X-Requested-With": "XMLHttpRequest"})
+
+	token = response.Header().Get(CSRF_HEADER)
+	if len(token) == 0 || len(db.sessions) != before+1 {
+		t.Fatalf("token = %v, sessions = %v", token, db.sessions)
+	}
+
+	//the new session is sent to the client
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SESSION_ID {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	return token, cookies[0].Value
+}
+
+func TestCSRF(t *testing.T) {
+	module := newCSRFTestModule("/api/", "/webhook")
+	token, session := csrfToken(t, module)
+	other_token, other_session := csrfToken(t, module)
+
+	form := url.Values{CSRF_FIELD: {token}}.Encode()
+
+	multipart_body := &bytes.Buffer{}
+	writer := multipart.NewWriter(multipart_body)
+	writer.WriteField(CSRF_FIELD, token)
+	writer.Close()
+
+	tests := []struct {
+		Name, Method, Path, Session, ContentType, Body string
+		Header                                         map[string]string
+		Status                                         int
+	}{
+		{"safe method", "GET", "/form", session, "", "", nil, http.StatusOK},
+		{"no token", "POST", "/form", session, "", "", nil, http.StatusForbidden},
+		{"no session", "POST", "/form", "", "", "", map[string]string{CSRF_HEADER: token}, http.StatusForbidden},
+		{"header", "POST", "/form", session, "application/json", "{}", map[string]string{CSRF_HEADER: token}, http.StatusOK},
+		{"form field", "POST", "/form", session, "application/x-www-form-urlencoded", form, nil, http.StatusOK},
+		{"multipart field", "POST", "/form", session, writer.FormDataContentType(), multipart_body.String(), nil, http.StatusOK},
+		{"put", "PUT", "/items/1", session, "", "", map[string]string{CSRF_HEADER: token}, http.StatusOK},
+		{"delete without token", "DELETE", "/items/1", session, "", "", nil, http.StatusForbidden},
+		{"other session", "POST", "/form", session, "", "", map[string]string{CSRF_HEADER: other_token}, http.StatusForbidden},
+		{"other session's own token", "POST", "/form", other_session, "", "", map[string]string{CSRF_HEADER: other_token}, http.StatusOK},
+		{"invalid token", "POST", "/form", session, "", "", map[string]string{CSRF_HEADER: "abc"}, http.StatusForbidden},
+		{"json field is ignored", "POST", "/form", session, "application/json", `{"csrf_token":"` + token + `"}`, nil, http.StatusForbidden},
+		{"exempt prefix", "POST", "/api/hooks/github", "", "", "", nil, http.StatusOK},
+		{"exempt path", "POST", "/webhook", "", "", "", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		response := csrfRequest(module, test.Method, test.Path, test.Session, test.ContentType, test.Body, test.Header)
+
+		if response.Code != test.Status {
+			t.Errorf("%v: status = %v, expected %v (%v)", test.Name, response.Code, test.Status, response.Body.String())
+		}
+	}
+}
+
+func TestCSRF_XHRRejection(t *testing.T) {
+	module := newCSRFTestModule()
+	_, session := csrfToken(t, module)
+
+	response := csrfRequest(module, "POST", "/form", session, "", "", map[string]string{"X-Requested-With": "XMLHttpRequest"})
+
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), `"success":false`) {
+		t.Errorf("status = %v, body = %v", response.Code, response.Body.String())
+	}
+}
+
+func TestRequest_CSRFToken(t *testing.T) {
+	module := &Module{Db: newSessionDatabase()}
+
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	r := NewRequest(request, "/", module)
+
+	first, err := r.CSRFToken()
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	second, _ := r.CSRFToken()
+
+	//tokens are masked differently every time, but they share the secret
+	if first == second {
+		t.Errorf("tokens are the same: %v", first)
+	}
+
+	for _, token := range []string{first, second} {
+		if valid, err := r.validCSRFToken(token); !valid || err != nil {
+			t.Errorf("token %v: valid = %v, err = %v", token, valid, err)
+		}
+	}
+}
+
+func TestModule_RenderTemplate_CSRF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perfect-csrf")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, TEMPLATE_DIR), 0755)
+	err = ioutil.WriteFile(filepath.Join(dir, TEMPLATE_DIR, "form.html"), []byte(`<input name="csrf_token" value="<% csrf %>">`), 0644)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	module := &Module{Name: "csrf", Mux: NewPrettyMux(), Path: dir, Db: newSessionDatabase()}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost/form", nil)
+	r := NewRequest(request, "/form", module)
+
+	//templates can be rendered more than once
+	for i := 0; i < 2; i++ {
+		response := httptest.NewRecorder()
+		module.RenderTemplate(response, r, "form", nil)
+
+		matches := regexp.MustCompile(`value="([^"]+)"`).FindStringSubmatch(response.Body.String())
+		if matches == nil {
+			t.Fatalf("body = %v", response.Body.String())
+		}
+
+		if valid, err := r.validCSRFToken(matches[1]); !valid || err != nil {
+			t.Errorf("token %v: valid = %v, err = %v", matches[1], valid, err)
+		}
+
+		//the new session is sent with the page
+		if cookies := response.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != *r.session.Id {
+			t.Errorf("cookies = %v", cookies)
+		}
+	}
+}
@@ -11,4 +11,24 @@ var (
 	ErrInvalidCollection = errors.New("Invalid collection")
 	ErrUnauthorized      = errors.New("Unauthorized request")
 	ErrNoSuchForm        = errors.New("Form does not exist")
+	ErrInvalidRoute      = errors.New("Invalid route")
+	ErrNoSuchRoute       = errors.New("No such route")
+	ErrDuplicateRoute    = errors.New("Duplicate route")
+	ErrMissingParameter  = errors.New("Missing route parameter")
+	ErrInvalidParameter  = errors.New("Invalid route parameter")
+	ErrInvalidMountPoint = errors.New("Invalid mount point")
+	ErrMountConflict     = errors.New("Mount point conflict")
+	ErrNotMounted        = errors.New("No module mounted on path")
+	ErrNotFlushable      = errors.New("Response writer does not support flushing")
+	ErrInvalidEvent      = errors.New("Invalid event")
+	ErrNotHijackable     = errors.New("Response writer does not support hijacking")
+	ErrInvalidHandshake  = errors.New("Invalid WebSocket handshake")
+	ErrWebSocketClosed   = errors.New("WebSocket connection closed")
+	ErrMessageTooBig     = errors.New("WebSocket message too big")
+	ErrInvalidCSRFToken  = errors.New("Invalid CSRF token")
+	ErrTooManyRequests   = errors.New("Too many requests")
+	ErrBodyTooLarge      = errors.New("Request body too large")
+	ErrTrailingData      = errors.New("Unexpected data after JSON value")
+	ErrNoSuchTemplate    = errors.New("Template not found")
+	ErrNoStaticFiles     = errors.New("Module has no static files")
 )
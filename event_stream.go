@@ -0,0 +1,266 @@
+package perfect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//how often an idle event stream sends a comment, so that proxies don't
+	//close the connection
+	EVENT_STREAM_KEEPALIVE = 15 * time.Second
+)
+
+//changed by tests
+var eventStreamKeepAlive = EVENT_STREAM_KEEPALIVE
+
+//A Server-Sent Event
+type Event struct {
+	Id    string
+	Event string        //the event type; browsers use 'message' if empty
+	Data  string        //can have multiple lines
+	Retry time.Duration //how long the browser waits before reconnecting
+}
+
+//writes the event in the text/event-stream format
+func (e *Event) writeTo(w *strings.Builder) error {
+	if strings.ContainsAny(e.Id, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return fmt.Errorf("%s: id and event can't contain line breaks", ErrInvalidEvent)
+	}
+
+	if len(e.Id) > 0 {
+		w.WriteString("id: " + e.Id + "\n")
+	}
+
+	if len(e.Event) > 0 {
+		w.WriteString("event: " + e.Event + "\n")
+	}
+
+	if e.Retry > 0 {
+		w.WriteString("retry: " + strconv.FormatInt(int64(e.Retry/time.Millisecond), 10) + "\n")
+	}
+
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(e.Data)
+	for _, line := range strings.Split(data, "\n") {
+		w.WriteString("data: " + line + "\n")
+	}
+
+	w.WriteString("\n")
+
+	return nil
+}
+
+//Keeps recent events, so that clients that reconnect can receive the events
+//they missed
+type EventBacklog interface {
+	Add(e *Event)
+
+	//returns the events after the one with the given id. If the id is
+	//unknown, i.e. because it's too old, all events are returned.
+	Since(id string) []*Event
+}
+
+//An EventBacklog that keeps the last Size events in memory
+type MemoryBacklog struct {
+	Size   int
+	lock   sync.RWMutex
+	events []*Event
+}
+
+//returns a backlog of the last size events
+func NewMemoryBacklog(size int) *MemoryBacklog {
+	return &MemoryBacklog{
+		Size:   size,
+		events: make([]*Event, 0, size),
+	}
+}
+
+func (b *MemoryBacklog) Add(e *Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.events = append(b.events, e)
+	if len(b.events) > b.Size {
+		b.events = append(b.events[:0], b.events[len(b.events)-b.Size:]...)
+	}
+}
+
+func (b *MemoryBacklog) Since(id string) []*Event {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	start := 0
+	for i := len(b.events) - 1; i >= 0; i-- {
+		if b.events[i].Id == id {
+			start = i + 1
+			break
+		}
+	}
+
+	result := make([]*Event, len(b.events)-start)
+	copy(result, b.events[start:])
+
+	return result
+}
+
+//Sends Server-Sent Events to a client. All methods can be called from
+//multiple goroutines.
+type EventStream struct {
+	//the id of the last event the client received before reconnecting
+	LastEventId string
+
+	lock    sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+//returns the http.Flusher of a response writer, looking through writers that
+//wrap other writers
+func findFlusher(w http.ResponseWriter) http.Flusher {
+	for {
+		if flusher, ok := w.(http.Flusher); ok {
+			return flusher
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+//Starts an event stream: sends the headers, and a comment every
+//EVENT_STREAM_KEEPALIVE while the stream is open. The stream is done when
+//the client disconnects, or when Close is called.
+//Returns ErrNotFlushable if events can't be sent as they happen.
+func (r *Request) EventStream(w http.ResponseWriter) (*EventStream, error) {
+	flusher := findFlusher(w)
+	if flusher == nil {
+		return nil, ErrNotFlushable
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+
+	stream := &EventStream{
+		LastEventId: r.Header.Get("Last-Event-ID"),
+		w:           w,
+		flusher:     flusher,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	//tells nginx not to buffer the stream
+	header.Set("X-Accel-Buffering", "no")
+	header.Del("Content-Length")
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	go stream.keepAlive(eventStreamKeepAlive)
+
+	return stream, nil
+}
+
+//sends comments until the stream is done
+func (s *EventStream) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.write(": keepalive\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+//writes data to the client and flushes it
+func (s *EventStream) write(data string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := s.w.Write([]byte(data)); err != nil {
+		s.cancel()
+		return err
+	}
+
+	s.flusher.Flush()
+
+	return nil
+}
+
+//Sends an event. Returns an error if the client has disconnected, or if the
+//stream has been closed.
+func (s *EventStream) Send(e *Event) error {
+	buf := &strings.Builder{}
+	if err := e.writeTo(buf); err != nil {
+		return err
+	}
+
+	return s.write(buf.String())
+}
+
+//Sends v as the JSON data of an event of the given type
+func (s *EventStream) SendJSON(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.Send(&Event{Event: event, Data: string(data)})
+}
+
+//Sends the events that the client missed, if it reconnected with a
+//Last-Event-ID header
+func (s *EventStream) Replay(backlog EventBacklog) error {
+	if len(s.LastEventId) == 0 {
+		return nil
+	}
+
+	for _, e := range backlog.Since(s.LastEventId) {
+		if err := s.Send(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Returns a channel that is closed when the client disconnects, or when the
+//stream is closed
+func (s *EventStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+//Stops the stream. Handlers must call Close before they return, since the
+//stream can't be written to after that:
+//	stream, err := r.EventStream(w)
+//	if err != nil { ... }
+//	defer stream.Close()
+func (s *EventStream) Close() {
+	s.cancel()
+
+	//wait for writes in progress
+	s.lock.Lock()
+	s.lock.Unlock()
+}
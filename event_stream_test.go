@@ -0,0 +1,183 @@
+package perfect
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvent_Format(t *testing.T) {
+	tests := []struct {
+		Event    Event
+		Expected string
+	}{
+		{Event{Data: "hello"}, "data: hello\n\n"},
+		{Event{Id: "7", Event: "progress", Data: "50%", Retry: 3 * time.Second}, "id: 7\nevent: progress\nretry: 3000\ndata: 50%\n\n"},
+		{Event{Data: "line 1\nline 2\r\nline 3\rline 4"}, "data: line 1\ndata: line 2\ndata: line 3\ndata: line 4\n\n"},
+		{Event{}, "data: \n\n"},
+	}
+
+	for _, test := range tests {
+		buf := &strings.Builder{}
+		if err := test.Event.writeTo(buf); err != nil {
+			t.Errorf("%#v: err = %v", test.Event, err)
+			continue
+		}
+
+		if buf.String() != test.Expected {
+			t.Errorf("%#v: %q, expected %q", test.Event, buf.String(), test.Expected)
+		}
+	}
+
+	for _, e := range []Event{{Id: "1\n2"}, {Event: "a\rb"}, {Id: "\x00"}} {
+		if err := e.writeTo(&strings.Builder{}); err == nil {
+			t.Errorf("%#v: expected an error", e)
+		}
+	}
+}
+
+func TestMemoryBacklog(t *testing.T) {
+	backlog := NewMemoryBacklog(3)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		backlog.Add(&Event{Id: id})
+	}
+
+	tests := map[string]string{
+		"4": "5",
+		"3": "4,5",
+		"5": "",
+		"1": "3,4,5",
+		"":  "3,4,5",
+	}
+
+	for id, expected := range tests {
+		ids := make([]string, 0)
+		for _, e := range backlog.Since(id) {
+			ids = append(ids, e.Id)
+		}
+
+		if strings.Join(ids, ",") != expected {
+			t.Errorf("Since(%v) = %v, expected %v", id, ids, expected)
+		}
+	}
+}
+
+func TestRequest_EventStream(t *testing.T) {
+	eventStreamKeepAlive = 20 * time.Millisecond
+	defer func() {
+		eventStreamKeepAlive = EVENT_STREAM_KEEPALIVE
+	}()
+
+	backlog := NewMemoryBacklog(10)
+	backlog.Add(&Event{Id: "1", Data: "first"})
+	backlog.Add(&Event{Id: "2", Data: "second"})
+
+	disconnected := make(chan bool, 1)
+
+	module := &Module{Name: "events", Mux: NewPrettyMux()}
+	module.Get("/events", func(w http.ResponseWriter, r *Request) {
+		stream, err := r.EventStream(w)
+		if err != nil {
+			Error(w, r, err)
+			return
+		}
+		defer stream.Close()
+
+		if err := stream.Replay(backlog); err != nil {
+			t.Errorf("err = %v", err)
+		}
+
+		stream.Send(&Event{Id: "3", Event: "progress", Data: "50%"})
+		stream.SendJSON("done", map[string]int{"progress": 100})
+
+		<-stream.Done()
+		disconnected <- true
+	})
+
+	mux := NewModuleMux()
+	mux.Mount(module, "/")
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	request = request.WithContext(ctx)
+	request.Header.Set("Last-Event-ID", "1")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	defer response.Body.Close()
+
+	if ct := response.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %v", ct)
+	}
+
+	if cc := response.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %v", cc)
+	}
+
+	expected := []string{
+		"id: 2", "data: second", "",
+		"id: 3", "event: progress", "data: 50%", "",
+		"event: done", `data: {"progress":100}`, "",
+		": keepalive", "",
+	}
+
+	reader := bufio.NewReader(response.Body)
+	for _, line := range expected {
+		actual, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+
+		if strings.TrimSuffix(actual, "\n") != line {
+			t.Fatalf("line = %q, expected %q", actual, line)
+		}
+	}
+
+	//the handler must notice that the client is gone
+	cancel()
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatalf("the handler did not detect the disconnect")
+	}
+}
+
+func TestRequest_EventStreamHEAD(t *testing.T) {
+	request, _ := http.NewRequest("HEAD", "http://localhost/events", nil)
+	r := NewRequest(request, "/events", &Module{})
+	w := httptest.NewRecorder()
+
+	//HEAD requests go through headResponseWriter, which can still be flushed
+	stream, err := r.EventStream(&headResponseWriter{w})
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	stream.Close()
+
+	if !w.Flushed {
+		t.Errorf("the response was not flushed")
+	}
+
+	if err := stream.Send(&Event{Data: "x"}); err == nil {
+		t.Errorf("expected an error after Close")
+	}
+
+	//writers that can't be flushed
+	_, err = r.EventStream(struct{ http.ResponseWriter }{w})
+	if err != ErrNotFlushable {
+		t.Errorf("err = %v, expected %v", err, ErrNotFlushable)
+	}
+}
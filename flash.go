@@ -0,0 +1,86 @@
+package perfect
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	//the session value that holds the flash messages
+	FLASH_SESSION_KEY = "flash"
+)
+
+//Adds a message to show on the next page that the session renders, i.e.
+//after a redirect. Templates read the messages with the 'flash' function:
+//	<% range flash %><p class="flash"><% . %></p><% end %>
+func (r *Request) AddFlash(w http.ResponseWriter, message string) error {
+	session, err := r.Session()
+	if err != nil {
+		return err
+	}
+
+	messages, err := sessionFlashes(session)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(append(messages, message))
+	if err != nil {
+		return err
+	}
+
+	(*session.Values)[FLASH_SESSION_KEY] = string(data)
+
+	if err := r.Module.Db.Save(session); err != nil {
+		return err
+	}
+
+	r.sendSessionCookie(w)
+
+	return nil
+}
+
+//Returns the flash messages of the session, and removes them. Requests
+//without a session have no messages, and don't get a new session.
+func (r *Request) Flashes() ([]string, error) {
+	if !r.hasSession() {
+		return nil, nil
+	}
+
+	session, err := r.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := sessionFlashes(session)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	delete(*session.Values, FLASH_SESSION_KEY)
+
+	if err := r.Module.Db.Save(session); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+//returns the flash messages stored in a session
+func sessionFlashes(session *Session) ([]string, error) {
+	if session.Values == nil {
+		session.Values = &map[string]string{}
+	}
+
+	data, ok := (*session.Values)[FLASH_SESSION_KEY]
+	if !ok {
+		return nil, nil
+	}
+
+	messages := []string{}
+	if err := json.Unmarshal([]byte(data), &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
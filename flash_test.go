@@ -0,0 +1,61 @@
+package perfect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRequest_Flash(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{
+		"page": `<% path %>:<% range flash %>[<% . %>]<% end %>:<% with profile %><% .Name %><% end %>`,
+	})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "flash", Mux: NewPrettyMux(), Path: dir, Db: newSessionDatabase()}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	module.Post("/save", func(w http.ResponseWriter, r *Request) {
+		r.AddFlash(w, "saved")
+		r.AddFlash(w, "<done>")
+		Redirect(w, r, "/page")
+	})
+
+	module.Get("/page", func(w http.ResponseWriter, r *Request) {
+		module.RenderTemplate(w, r, "page", nil)
+	})
+
+	request, _ := http.NewRequest("POST", "http://localhost/save", nil)
+	response := httptest.NewRecorder()
+	module.Route(response, NewRequest(request, "/save", module))
+
+	//the new session is sent once
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SESSION_ID {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	//messages are shown once
+	for _, body := range []string{"/page:[saved][&lt;done&gt;]:", "/page::"} {
+		request, _ = http.NewRequest("GET", "http://localhost/page", nil)
+		request.AddCookie(cookies[0])
+		response = httptest.NewRecorder()
+		module.Route(response, NewRequest(request, "/page", module))
+
+		if response.Body.String() != body {
+			t.Errorf("body = %q, expected %q", response.Body.String(), body)
+		}
+	}
+
+	//visitors without a session don't get one
+	request, _ = http.NewRequest("GET", "http://localhost/page", nil)
+	response = httptest.NewRecorder()
+	module.Route(response, NewRequest(request, "/page", module))
+
+	if response.Body.String() != "/page::" || len(response.Result().Cookies()) != 0 {
+		t.Errorf("body = %q, cookies = %v", response.Body.String(), response.Result().Cookies())
+	}
+}
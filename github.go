@@ -1,5 +1,19 @@
 package perfect
 
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	GITHUB_API_URL = "https://api.github.com"
+
+	//issue titles only include the start of the error message
+	GITHUB_TITLE_LENGTH = 80
+)
+
 type GithubIssue struct {
 	Title  string   `json:"title"`
 	Body   string   `json:"body"`
@@ -13,3 +27,75 @@ type GithubResponse struct {
 	HtmlUrl     string `json:"html_url"`
 	IssueNumber int    `json:"number"`
 }
+
+//Creates a GitHub issue for each report
+type GithubReporter struct {
+	URL    string //the issues endpoint of the repository
+	Token  string //a token that can create issues in the repository
+	Labels []string
+	Client *http.Client
+}
+
+//returns a reporter that creates issues in repo (i.e. 'owner/name'), using
+//token for authentication
+func NewGithubReporter(repo, token string, labels ...string) *GithubReporter {
+	return &GithubReporter{
+		URL:    GITHUB_API_URL + "/repos/" + repo + "/issues",
+		Token:  token,
+		Labels: append([]string{"auto", "panic"}, labels...),
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (gr *GithubReporter) Report(report *PanicReport) error {
+	details, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	issue := &GithubIssue{
+		Title: githubIssueTitle(report),
+		Body:  report.Error + "\n\nStack:\n```\n" + report.Stack + "```\n\nReport:\n```json\n" + string(details) + "\n```\n",
+	}
+
+	for _, label := range append(append([]string{}, gr.Labels...), report.Module) {
+		if len(label) > 0 {
+			issue.Labels = append(issue.Labels, label)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	if len(gr.Token) > 0 {
+		header.Set("Authorization", "token "+gr.Token)
+	}
+
+	data, err := postJSON(gr.Client, gr.URL, header, issue)
+	if err != nil {
+		return err
+	}
+
+	response := &GithubResponse{}
+
+	return json.Unmarshal(data, response)
+}
+
+//returns the title of the issue for report. Titles are public and show up in
+//notifications, so only the first line of the error is used, and long
+//messages are truncated.
+func githubIssueTitle(report *PanicReport) string {
+	message := report.Error
+	if i := strings.IndexAny(message, "\r\n"); i >= 0 {
+		message = message[:i]
+	}
+
+	if runes := []rune(message); len(runes) > GITHUB_TITLE_LENGTH {
+		message = string(runes[:GITHUB_TITLE_LENGTH]) + "..."
+	}
+
+	if len(report.Module) == 0 {
+		return "Automatic Panic Report: " + message
+	}
+
+	return "Automatic Panic Report (" + report.Module + "): " + message
+}
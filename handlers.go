@@ -34,8 +34,9 @@ func NotLoggedIn(handler RequestHandler) RequestHandler {
 	}
 }
 
-func NotFound(w http.ResponseWriter) {
-	http.Error(w, "Not Found", http.StatusNotFound)
+//returns 404 Not Found, with the module's error template for browsers
+func NotFound(w http.ResponseWriter, r *Request) {
+	writeErrorPage(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
 }
 
 //returns 204 No Content
@@ -54,16 +55,23 @@ func LogError(r *Request, err error) {
 	log.Printf("ERROR:%s:%d: %s\n%s", file, line, err, info)
 }
 
-//returns 500 Internal Server Error, and prints the error to the server log
+//responds with the status code of the error (see ErrorStatus), and logs it.
+//The response is a JSONResponse for XHR requests and clients that accept
+//JSON, the module's error template if it has one, or plain text.
+//The details of server errors are only logged, never sent to the client.
 func Error(w http.ResponseWriter, r *Request, err error) {
-	log.Printf("header=%#v\n", w.Header())
-	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	status := ErrorStatus(err)
+
+	writeErrorPage(w, r, status, errorMessage(err, status))
 
 	//log the error
 	if r.Module.Log != nil {
-		info := debug.Stack()
 		_, file, line, _ := runtime.Caller(1)
-		r.Module.Log.Printf("ERROR:%s:%d: %s\n%s", file, line, err, info)
+		if status >= http.StatusInternalServerError {
+			r.Module.Log.Printf("ERROR:%s:%d: %s\n%s", file, line, err, debug.Stack())
+		} else {
+			r.Module.Log.Printf("ERROR:%s:%d: %d %s", file, line, status, err)
+		}
 	}
 }
 
@@ -118,13 +126,18 @@ func BadRequest(w http.ResponseWriter) {
 }
 
 //returns 401 Unauthorized
-func Unauthorized(w http.ResponseWriter, err error) {
-	http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+func Unauthorized(w http.ResponseWriter, r *Request, err error) {
+	writeErrorPage(w, r, http.StatusUnauthorized, "Unauthorized: "+err.Error())
 }
 
 //For debugging purposes only
 func HandlerInfo(h RequestHandler) (name string, file string, line int) {
-	value := reflect.ValueOf(h)
+	return funcInfo(h)
+}
+
+//returns the name and location of any func value
+func funcInfo(fn interface{}) (name string, file string, line int) {
+	value := reflect.ValueOf(fn)
 	ptr := value.Pointer()
 	f := runtime.FuncForPC(ptr)
 
@@ -84,8 +84,9 @@ func TestNotLoggedIn(t *testing.T) {
 
 func TestNotFound(t *testing.T) {
 	response := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://localhost/missing", nil)
 
-	NotFound(response)
+	NotFound(response, NewRequest(request, "/missing", &Module{}))
 
 	if response.Code != http.StatusNotFound {
 		t.Errorf("responses.Status is %v, expected %v (http.StatusNotFound)", response.Code, http.StatusNotFound)
@@ -338,8 +339,9 @@ func TestBadRequest(t *testing.T) {
 func TestUnauthorized(t *testing.T) {
 	response := httptest.NewRecorder()
 	err := errors.New("Access is denied")
+	request, _ := http.NewRequest("GET", "http://localhost/admin", nil)
 
-	Unauthorized(response, err)
+	Unauthorized(response, NewRequest(request, "/admin", &Module{}), err)
 
 	if response.Code != http.StatusUnauthorized {
 		t.Errorf("response.Code is %v, expected %v (http.StatusUnauthorized)", response.Code, http.StatusUnauthorized)
@@ -0,0 +1,185 @@
+package perfect
+
+import (
+	"errors"
+	"github.com/vpetrov/perfect/orm"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//the module template used to render errors for browsers, if it exists
+	ERROR_TEMPLATE = "error"
+	//the folder of templates for specific status codes, i.e. 'errors/404',
+	//which are used instead of ERROR_TEMPLATE
+	ERROR_TEMPLATE_DIR = "errors"
+)
+
+//An error with an HTTP status code. Message is sent to the client, while Err
+//is only logged.
+type HTTPError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+//returns a new HTTPError. If message is empty, the status text is used.
+func NewHTTPError(status int, message string, err error) *HTTPError {
+	if len(message) == 0 {
+		message = http.StatusText(status)
+	}
+
+	return &HTTPError{
+		Status:  status,
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+
+	return e.Message
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+//the data passed to the error template
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+	Request    *Request
+}
+
+//status codes of errors that don't carry their own
+var (
+	errorStatusLock sync.RWMutex
+	errorStatus     = map[error]int{
+		ErrEmptyRequest:      http.StatusBadRequest,
+		ErrNotFound:          http.StatusNotFound,
+		ErrInvalidId:         http.StatusBadRequest,
+		ErrInvalidCollection: http.StatusBadRequest,
+		ErrUnauthorized:      http.StatusUnauthorized,
+		ErrNoSuchForm:        http.StatusNotFound,
+		ErrInvalidCSRFToken:  http.StatusForbidden,
+		ErrTooManyRequests:   http.StatusTooManyRequests,
+		ErrBodyTooLarge:      http.StatusRequestEntityTooLarge,
+		ErrTrailingData:      http.StatusBadRequest,
+		orm.ErrNotFound:      http.StatusNotFound,
+	}
+)
+
+//Sets the status code that Error sends for err, and for any error that
+//wraps it
+func RegisterErrorStatus(err error, status int) {
+	errorStatusLock.Lock()
+	errorStatus[err] = status
+	errorStatusLock.Unlock()
+}
+
+//implemented by errors that know their status code, i.e. ValidationErrors
+type statusCoder interface {
+	StatusCode() int
+}
+
+//Returns the status code of an error: the status of an HTTPError or of an
+//error with a StatusCode() method, the registered status of an error or of
+//any error it wraps, or 500 Internal Server Error.
+func ErrorStatus(err error) int {
+	var http_err *HTTPError
+	if errors.As(err, &http_err) {
+		return http_err.Status
+	}
+
+	errorStatusLock.RLock()
+	defer errorStatusLock.RUnlock()
+
+	for ; err != nil; err = errors.Unwrap(err) {
+		if coder, ok := err.(statusCoder); ok {
+			return coder.StatusCode()
+		}
+
+		//errors that can't be map keys, i.e. slices, can't be registered
+		if !reflect.TypeOf(err).Comparable() {
+			continue
+		}
+
+		if status, ok := errorStatus[err]; ok {
+			return status
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+//returns the message of an error that is safe to send to the client. The
+//details of server errors are never sent.
+func errorMessage(err error, status int) string {
+	var http_err *HTTPError
+	if errors.As(err, &http_err) && len(http_err.Message) > 0 {
+		return http_err.Message
+	}
+
+	if status >= http.StatusInternalServerError || err == nil {
+		return http.StatusText(status)
+	}
+
+	return err.Error()
+}
+
+//checks whether the client expects a JSON response
+func wantsJSON(r *Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+//writes the error page, using the module's template for the status code, or
+//its error template, if they exist
+func writeErrorPage(w http.ResponseWriter, r *Request, status int, message string) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		JSONResult(w, r, false, message)
+		return
+	}
+
+	var (
+		set  *templateSet
+		name string
+	)
+
+	if r.Module != nil {
+		//the templates can't be used if they failed to parse
+		set, name, _ = r.Module.findTemplate(ERROR_TEMPLATE_DIR + "/" + strconv.Itoa(status))
+		if set == nil {
+			set, name, _ = r.Module.findTemplate(ERROR_TEMPLATE)
+		}
+	}
+
+	if set != nil {
+		page := &ErrorPage{
+			Status:     status,
+			StatusText: http.StatusText(status),
+			Message:    message,
+			Request:    r,
+		}
+
+		//a broken template doesn't result in half an error page
+		err := set.render(w, r, name, status, page)
+		if err == nil {
+			return
+		}
+
+		LogError(r, err)
+	}
+
+	http.Error(w, message, status)
+}
@@ -0,0 +1,192 @@
+package perfect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vpetrov/perfect/orm"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	ErrCustom := errors.New("custom")
+	RegisterErrorStatus(ErrCustom, http.StatusTeapot)
+
+	tests := []struct {
+		Err    error
+		Status int
+	}{
+		{ErrNotFound, http.StatusNotFound},
+		{orm.ErrNotFound, http.StatusNotFound},
+		{ErrUnauthorized, http.StatusUnauthorized},
+		{ErrInvalidId, http.StatusBadRequest},
+		{ErrEmptyRequest, http.StatusBadRequest},
+		{fmt.Errorf("form 123: %w", orm.ErrNotFound), http.StatusNotFound},
+		{ErrCustom, http.StatusTeapot},
+		{NewHTTPError(http.StatusConflict, "", nil), http.StatusConflict},
+		{fmt.Errorf("saving: %w", NewHTTPError(http.StatusForbidden, "", ErrNotFound)), http.StatusForbidden},
+		{errors.New("database is down"), http.StatusInternalServerError},
+		{nil, http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if status := ErrorStatus(test.Err); status != test.Status {
+			t.Errorf("%v: status = %v, expected %v", test.Err, status, test.Status)
+		}
+	}
+}
+
+func TestError_Negotiation(t *testing.T) {
+	module := &Module{Name: "errors"}
+	module.Templates = template.Must(template.New(ERROR_TEMPLATE).Parse(`<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p>`))
+
+	tests := []struct {
+		Err     error
+		Header  map[string]string
+		Module  *Module
+		Status  int
+		Body    string
+		Content string
+	}{
+		{ErrNotFound, nil, module, http.StatusNotFound, "<h1>404 Not Found</h1><p>Not found</p>", "text/html; charset=utf-8"},
+		{ErrNotFound, nil, &Module{}, http.StatusNotFound, "Not found\n", "text/plain; charset=utf-8"},
+		{ErrNotFound, map[string]string{"Accept": "application/json"}, module, http.StatusNotFound, `{"success":false,"message":"Not found"}`, "application/json"},
+		{ErrUnauthorized, map[string]string{"X-Requested-With": "XMLHttpRequest"}, module, http.StatusUnauthorized, `{"success":false,"message":"Unauthorized request"}`, "application/json"},
+		{NewHTTPError(http.StatusConflict, "Name is taken", errors.New("duplicate key")), nil, &Module{}, http.StatusConflict, "Name is taken\n", "text/plain; charset=utf-8"},
+		//the details of server errors are never sent
+		{errors.New("connection refused"), nil, module, http.StatusInternalServerError, "<h1>500 Internal Server Error</h1><p>Internal Server Error</p>", "text/html; charset=utf-8"},
+		{errors.New("connection refused"), map[string]string{"Accept": "application/json"}, module, http.StatusInternalServerError, `{"success":false,"message":"Internal Server Error"}`, "application/json"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "http://localhost/", nil)
+		for key, value := range test.Header {
+			request.Header.Set(key, value)
+		}
+		response := httptest.NewRecorder()
+
+		Error(response, NewRequest(request, "/", test.Module), test.Err)
+
+		if response.Code != test.Status {
+			t.Errorf("%v: status = %v, expected %v", test.Err, response.Code, test.Status)
+		}
+
+		if response.Body.String() != test.Body {
+			t.Errorf("%v: body = %q, expected %q", test.Err, response.Body.String(), test.Body)
+		}
+
+		if ct := response.Header().Get("Content-Type"); ct != test.Content {
+			t.Errorf("%v: Content-Type = %v, expected %v", test.Err, ct, test.Content)
+		}
+
+		if strings.HasPrefix(test.Content, "application/json") {
+			result := &JSONResponse{}
+			if err := json.Unmarshal(response.Body.Bytes(), result); err != nil || result.Success {
+				t.Errorf("%v: result = %#v, err = %v", test.Err, result, err)
+			}
+		}
+	}
+}
+
+func TestError_BrokenTemplate(t *testing.T) {
+	module := &Module{Name: "errors"}
+	module.Templates = template.Must(template.New(ERROR_TEMPLATE).Parse(`<h1>{{.Missing}}</h1>`))
+
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	response := httptest.NewRecorder()
+
+	Error(response, NewRequest(request, "/", module), ErrNotFound)
+
+	if response.Code != http.StatusNotFound || response.Body.String() != "Not found\n" {
+		t.Errorf("status = %v, body = %q", response.Code, response.Body.String())
+	}
+}
+
+//tests that rendering the error template doesn't prevent the module's
+//templates from being rendered afterwards
+func TestError_TemplateReuse(t *testing.T) {
+	module := &Module{Name: "errors"}
+	module.Templates = template.Must(template.New(ERROR_TEMPLATE).Parse(`<h1>{{.Status}}</h1>`))
+	template.Must(module.Templates.New("page").Parse(`<p>page</p>`))
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "http://localhost/", nil)
+		r := NewRequest(request, "/", module)
+
+		response := httptest.NewRecorder()
+		Error(response, r, ErrNotFound)
+		if response.Body.String() != "<h1>404</h1>" {
+			t.Errorf("body = %q", response.Body.String())
+		}
+
+		response = httptest.NewRecorder()
+		module.RenderTemplate(response, r, "page", nil)
+		if response.Body.String() != "<p>page</p>" {
+			t.Errorf("body = %q", response.Body.String())
+		}
+	}
+}
+
+func TestError_StatusTemplates(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{
+		"layouts/main":              `<main><% block "content" . %><% end %></main>`,
+		ERROR_TEMPLATE:              `<h1><% .Status %> <% .Message %></h1>`,
+		ERROR_TEMPLATE_DIR + "/404": `<% layout "main" %><% define "content" %>no page at <% .Request.URL.Path %><% end %>`,
+		ERROR_TEMPLATE_DIR + "/500": `<p>sorry</p>`,
+		"broken":                    `<p><% .Missing %></p>`,
+		"created":                   `<p>created <% . %></p>`,
+	})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "errors", Mux: NewPrettyMux(), Path: dir}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	module.Get("/admin", func(w http.ResponseWriter, r *Request) {
+		Unauthorized(w, r, ErrUnauthorized)
+	})
+	module.Get("/broken", func(w http.ResponseWriter, r *Request) {
+		module.RenderTemplate(w, r, "broken", 1)
+	})
+	module.Get("/missing-template", func(w http.ResponseWriter, r *Request) {
+		module.RenderTemplate(w, r, "missing", nil)
+	})
+	module.Post("/items", func(w http.ResponseWriter, r *Request) {
+		module.RenderTemplateStatus(w, r, http.StatusCreated, "created", "item")
+	})
+	module.Post("/items.txt", func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		module.RenderTemplateStatus(w, r, http.StatusCreated, "created", "item")
+	})
+
+	tests := []struct {
+		Method, Path string
+		Status       int
+		ContentType  string
+		Body         string
+	}{
+		{"GET", "/nowhere", http.StatusNotFound, "text/html; charset=utf-8", "<main>no page at /nowhere</main>"},
+		{"GET", "/admin", http.StatusUnauthorized, "text/html; charset=utf-8", "<h1>401 Unauthorized: Unauthorized request</h1>"},
+		{"GET", "/broken", http.StatusInternalServerError, "text/html; charset=utf-8", "<p>sorry</p>"},
+		{"GET", "/missing-template", http.StatusInternalServerError, "text/html; charset=utf-8", "<p>sorry</p>"},
+		{"POST", "/items", http.StatusCreated, "text/html; charset=utf-8", "<p>created item</p>"},
+		{"POST", "/items.txt", http.StatusCreated, "text/plain; charset=utf-8", "<p>created item</p>"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.Method, "http://localhost"+test.Path, nil)
+		response := httptest.NewRecorder()
+		module.Route(response, NewRequest(request, test.Path, module))
+
+		if response.Code != test.Status || response.Header().Get("Content-Type") != test.ContentType || response.Body.String() != test.Body {
+			t.Errorf("%v %v: status = %v, type = %v, body = %q, expected %v, %v, %q", test.Method, test.Path,
+				response.Code, response.Header().Get("Content-Type"), response.Body.String(), test.Status, test.ContentType, test.Body)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package perfect
 
 import (
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -12,34 +15,59 @@ import (
 // then enabled. Should this change, an RWMutex will be necessary.
 type HTTPMux struct {
 	Handlers       map[string]routeHandlers
+	Names          map[string]string
 	staticPrefix   string
 	HasStaticFiles bool
+	middleware     []Middleware
+	routes         []RouteInfo
+	groups         routeGroups
+	static         *StaticFiles
 }
 
 //returns a new Mux
 func NewHTTPMux() *HTTPMux {
 	return &HTTPMux{
 		Handlers:       make(map[string]routeHandlers, 0),
+		Names:          make(map[string]string, 0),
 		staticPrefix:   "",
 		HasStaticFiles: false,
 	}
 }
 
-// finds and invokes the Handlers for the given request
+// finds and invokes the Handlers for the given request. Middleware added
+// with Use runs for every request, whether it is for a static resource, a
+// route, or a path that could not be found.
 func (h *HTTPMux) Route(w http.ResponseWriter, r *Request) {
 	handler := h.FindHandler(r)
 
 	if handler == nil {
-		http.NotFound(w, r.Request)
-		return
+		handler = h.groups.wrap(r.URL.Path, false, notFoundHandler)
+	} else {
+		//TODO: remove these 2 lines when optimizing performance
+		name, file, line := HandlerInfo(handler)
+		log.Printf("%s %s%s -> %s at %s:%d\n", r.Method, r.Module.MountPoint, Redact.URL(r.URL), name, file, line)
 	}
 
-	//TODO: remove these 2 lines when optimizing performance
-	name, file, line := HandlerInfo(handler)
-	log.Printf("%s %s%s -> %s at %s:%d\n", r.Method, r.Module.MountPoint, r.URL, name, file, line)
-
 	//invoke the handler
-	handler(w, r)
+	chain(h.middleware, handler)(w, r)
+}
+
+//adds middleware that runs for every request handled by this mux
+func (h *HTTPMux) Use(middleware ...Middleware) {
+	h.middleware = append(h.middleware, middleware...)
+}
+
+//returns a sub-router for routes that share a path prefix and middleware.
+//Requests for paths under the prefix that have no route, or no route for
+//their method, go through the middleware as well. Groups with an empty or
+//"/" prefix only wrap their own routes.
+func (h *HTTPMux) Group(prefix string, middleware ...Middleware) Mux {
+	return newRouteGroup(h, prefix, middleware)
+}
+
+//keeps track of a group, to apply its middleware to missing routes
+func (h *HTTPMux) addGroup(g *routeGroup) {
+	h.groups = append(h.groups, g)
 }
 
 //checks whether a request is for a static resource
@@ -47,8 +75,16 @@ func (h *HTTPMux) isStatic(r *Request) bool {
 	return h.HasStaticFiles && strings.HasPrefix(r.URL.Path, h.staticPrefix)
 }
 
-//generic method that registers a handler for a path and http method
-func (h *HTTPMux) Handle(method string, path string, handler RequestHandler) {
+//generic method that registers a handler for a path and http method, with
+//an optional route name that can be used to build URLs with BuildPath.
+//A handler registered again for the same method and path replaces the
+//earlier one. Panics if the name is already in use.
+func (h *HTTPMux) Handle(method string, path string, handler RequestHandler, name ...string) {
+	h.handle(method, path, handler, handler, name)
+}
+
+//registers handler, and records origin as the handler defined by the user
+func (h *HTTPMux) handle(method, path string, handler RequestHandler, origin interface{}, name []string) {
 
 	Handlers, ok := h.Handlers[method]
 
@@ -59,47 +95,88 @@ func (h *HTTPMux) Handle(method string, path string, handler RequestHandler) {
 
 	Handlers[path] = handler
 
+	for _, n := range name {
+		if _, ok := h.Names[n]; ok {
+			panic(fmt.Errorf("%s '%s'", ErrDuplicateRoute, n))
+		}
+		h.Names[n] = path
+	}
+
+	h.routes = append(h.routes, newRouteInfo(method, path, origin, name))
+
 	log.Println("[mux]", method, path, handler)
 }
 
-//sets the static path
+//returns all registered routes
+func (h *HTTPMux) Routes() []RouteInfo {
+	return copyRouteInfo(h.routes)
+}
+
+//sets the static path. Files are served from the module's directory.
 func (h *HTTPMux) Static(path string) {
+	h.StaticFS(path, nil)
+}
+
+//sets the static path, and the file system that static files are served
+//from, i.e. an embed.FS
+func (h *HTTPMux) StaticFS(path string, fsys fs.FS) {
 	if path[len(path)-1:] != "/" {
 		path += "/"
 	}
 
 	h.staticPrefix = path
 	h.HasStaticFiles = true
+	h.static = NewStaticFiles(fsys)
 }
 
 //a request handler for static resources
 func (h *HTTPMux) StaticHandler(w http.ResponseWriter, r *Request) {
-	http.ServeFile(w, r.Request, r.Module.Path+r.URL.Path)
+	h.StaticFiles().Serve(w, r, h.staticPrefix, strings.TrimPrefix(r.URL.Path, h.staticPrefix))
+}
+
+//returns the server for static files, to configure caching
+func (h *HTTPMux) StaticFiles() *StaticFiles {
+	if h.static == nil {
+		h.static = NewStaticFiles(nil)
+	}
+
+	return h.static
 }
 
 //registers a GET request handler
-func (h *HTTPMux) Get(path string, handler RequestHandler) {
-	h.Handle("GET", path, handler)
+func (h *HTTPMux) Get(path string, handler RequestHandler, name ...string) {
+	h.Handle("GET", path, handler, name...)
 }
 
 //registers a POST request handler
-func (h *HTTPMux) Post(path string, handler RequestHandler) {
-	h.Handle("POST", path, handler)
+func (h *HTTPMux) Post(path string, handler RequestHandler, name ...string) {
+	h.Handle("POST", path, handler, name...)
 }
 
 //registers a PUT request handler
-func (h *HTTPMux) Put(path string, handler RequestHandler) {
-	h.Handle("PUT", path, handler)
+func (h *HTTPMux) Put(path string, handler RequestHandler, name ...string) {
+	h.Handle("PUT", path, handler, name...)
 }
 
 //registers a DELETE request handler
-func (h *HTTPMux) Delete(path string, handler RequestHandler) {
-	h.Handle("DELETE", path, handler)
+func (h *HTTPMux) Delete(path string, handler RequestHandler, name ...string) {
+	h.Handle("DELETE", path, handler, name...)
+}
+
+//registers a PATCH request handler
+func (h *HTTPMux) Patch(path string, handler RequestHandler, name ...string) {
+	h.Handle("PATCH", path, handler, name...)
+}
+
+//registers a WebSocket endpoint. Requests that don't upgrade the connection
+//are refused with 400 Bad Request.
+func (h *HTTPMux) WebSocket(path string, handler WebSocketHandler, name ...string) {
+	h.handle("GET", path, webSocketHandler(handler), handler, name)
 }
 
 //registers a HEAD request handler
-func (h *HTTPMux) Head(path string, handler RequestHandler) {
-	h.Handle("HEAD", path, handler)
+func (h *HTTPMux) Head(path string, handler RequestHandler, name ...string) {
+	h.Handle("HEAD", path, handler, name...)
 }
 
 //returns a static/dynamic request handler for the given request
@@ -111,21 +188,45 @@ func (h *HTTPMux) FindHandler(r *Request) RequestHandler {
 		return h.StaticHandler
 	}
 
+	method := r.Request.Method
+
 	//GET, POST, PUT
-	route_handler, ok := h.Handlers[r.Request.Method]
+	handler, ok := h.Handlers[method][r.URL.Path]
+	if ok {
+		return handler
+	}
 
-	if !ok {
-		return nil
+	//HEAD requests are served by GET handlers, without the body
+	if method == "HEAD" {
+		if handler, ok = h.Handlers["GET"][r.URL.Path]; ok {
+			return headHandler(handler)
+		}
+	}
+
+	//405 Method Not Allowed or OPTIONS, if other methods handle this path
+	allowed := make([]string, 0)
+	for m, route_handlers := range h.Handlers {
+		if _, ok := route_handlers[r.URL.Path]; ok {
+			allowed = append(allowed, m)
+		}
+	}
+
+	if handler := missingMethodHandler(method, allowed); handler != nil {
+		return h.groups.wrap(r.URL.Path, false, handler)
 	}
 
-	//Find the handler
-	handler, ok := route_handler[r.URL.Path]
+	return nil
+}
 
+//returns the path of a named route, relative to the module. HTTPMux paths
+//have no named parameters, so params is never used.
+func (h *HTTPMux) BuildPath(name string, params url.Values) (string, error) {
+	path, ok := h.Names[name]
 	if !ok {
-		return nil
+		return "", fmt.Errorf("%s '%s'", ErrNoSuchRoute, name)
 	}
 
-	return handler
+	return path, nil
 }
 
 func (h *HTTPMux) StaticPrefix() string {
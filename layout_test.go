@@ -0,0 +1,106 @@
+package perfect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModule_Layouts(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{
+		"layouts/main": `<html><head><link href="<% asset "/app.css" %>"></head>` +
+			`<title><% block "title" . %>Default<% end %></title>` +
+			`<body><% block "content" . %><% end %><% partial "footer" %></body></html>`,
+		"partials/footer": `<footer>footer</footer>`,
+		"partials/user":   `<b><% .Name %></b>`,
+		"home": `<% layout "main" %>` +
+			`<% define "title" %>Home<% end %>` +
+			`<% define "content" %><a href="<% abs "/users" %>">users</a><% end %>`,
+		"users": `<% layout "main" %>` +
+			`<% define "content" %><% range . %><% partial "user" . %><% end %><% end %>`,
+		"plain": `<p><% partial "user" . %></p>`,
+	})
+	defer os.RemoveAll(dir)
+
+	shared, err := ioutil.TempDir("", "perfect-partials")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	defer os.RemoveAll(shared)
+
+	//shared partials are replaced by the module's own
+	ioutil.WriteFile(filepath.Join(shared, "footer"+TEMPLATE_EXT), []byte(`<footer>shared</footer>`), 0644)
+	ioutil.WriteFile(filepath.Join(shared, "flash"+TEMPLATE_EXT), []byte(`<div class="flash"><% . %></div>`), 0644)
+	writeTemplate(t, dir, "flash", `<% partial "flash" "saved <ok>" %>`)
+
+	module := &Module{
+		Name:        "layouts",
+		Mux:         NewPrettyMux(),
+		Path:        dir,
+		MountPoint:  "/app",
+		PartialDirs: []string{shared},
+	}
+
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	users := []map[string]string{{"Name": "bob"}, {"Name": "<alice>"}}
+
+	tests := []struct {
+		Template string
+		Data     interface{}
+		Body     string
+	}{
+		{"home", nil, `<html><head><link href="/app/app.css"></head><title>Home</title>` +
+			`<body><a href="/app/users">users</a><footer>footer</footer></body></html>`},
+		{"users", users, `<html><head><link href="/app/app.css"></head><title>Default</title>` +
+			`<body><b>bob</b><b>&lt;alice&gt;</b><footer>footer</footer></body></html>`},
+		{"plain", users[0], `<p><b>bob</b></p>`},
+		{"flash", nil, `<div class="flash">saved &lt;ok&gt;</div>`},
+	}
+
+	for _, test := range tests {
+		response := renderTemplate(module, test.Template, test.Data)
+
+		if response.Body.String() != test.Body {
+			t.Errorf("%v: body = %q, expected %q", test.Template, response.Body.String(), test.Body)
+		}
+	}
+}
+
+func TestModule_Layouts_Errors(t *testing.T) {
+	tests := []struct {
+		Templates map[string]string
+		Error     string
+	}{
+		{map[string]string{"page": `<% layout "missing" %>`}, "no such layout 'layouts/missing'"},
+		{map[string]string{"layouts/main": `<% block "content" . %><% end %>`, "page": `<% layout "main" %><% define "content" %><% .Name <% end %>`}, "page.html"},
+	}
+
+	for _, test := range tests {
+		dir := newTemplateTestDir(t, test.Templates)
+		defer os.RemoveAll(dir)
+
+		module := &Module{Name: "layouts", Mux: NewPrettyMux(), Path: dir}
+
+		if err := module.ParseTemplates(); err == nil || !strings.Contains(err.Error(), test.Error) {
+			t.Errorf("err = %v, expected %q", err, test.Error)
+		}
+	}
+
+	//partials that don't exist fail the render
+	dir := newTemplateTestDir(t, map[string]string{"page": `<% partial "missing" %>`})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "layouts", Mux: NewPrettyMux(), Path: dir}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if response := renderTemplate(module, "page", nil); strings.Contains(response.Body.String(), "missing") {
+		t.Errorf("body = %q", response.Body.String())
+	}
+}
@@ -0,0 +1,258 @@
+package perfect
+
+import (
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//A Middleware wraps a RequestHandler, usually to run code before or after it
+//or to decide whether it should run at all.
+type Middleware func(RequestHandler) RequestHandler
+
+//wraps the handler with all middleware, so that the first middleware is the
+//outermost one and runs first
+func chain(middleware []Middleware, handler RequestHandler) RequestHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+//responds with 404 Not Found
+func notFoundHandler(w http.ResponseWriter, r *Request) {
+	NotFound(w, r)
+}
+
+//A group of routes that share a path prefix and middleware. Middleware
+//added to the mux with Use runs first, for every request, followed by the
+//middleware of each group, from the outermost to the innermost one.
+type routeGroup struct {
+	mux        Mux
+	prefix     string
+	middleware []Middleware
+}
+
+//A mux that keeps track of its groups, so that the responses it makes up
+//for paths without a route, i.e. 404 Not Found or 405 Method Not Allowed,
+//go through the same middleware as the routes of the group
+type groupMux interface {
+	addGroup(g *routeGroup)
+}
+
+//the groups of a mux
+type routeGroups []*routeGroup
+
+//returns a new group of routes, registered on mux
+func newRouteGroup(mux Mux, prefix string, middleware []Middleware) *routeGroup {
+	//make a copy, so that the caller can't change the middleware list
+	m := make([]Middleware, len(middleware))
+	copy(m, middleware)
+
+	g := &routeGroup{
+		mux:        mux,
+		prefix:     prefix,
+		middleware: m,
+	}
+
+	if root, ok := g.root().(groupMux); ok {
+		root.addGroup(g)
+	}
+
+	return g
+}
+
+//returns the mux that the routes of the group are registered on
+func (g *routeGroup) root() Mux {
+	if parent, ok := g.mux.(*routeGroup); ok {
+		return parent.root()
+	}
+
+	return g.mux
+}
+
+//returns the prefix of the group, including the prefixes of its parents
+func (g *routeGroup) fullPrefix() string {
+	if parent, ok := g.mux.(*routeGroup); ok {
+		return parent.fullPrefix() + g.prefix
+	}
+
+	return g.prefix
+}
+
+//wraps the handler with the middleware of the group and its parents, in
+//the same order as the routes of the group
+func (g *routeGroup) wrapAll(handler RequestHandler) RequestHandler {
+	handler = g.wrap(handler)
+
+	if parent, ok := g.mux.(*routeGroup); ok {
+		return parent.wrapAll(handler)
+	}
+
+	return handler
+}
+
+//wraps a handler that the mux made up for path with the middleware of the
+//group with the longest prefix that matches the path. Named parameters of
+//pretty prefixes match any segment, if params is true. Groups without a
+//prefix are skipped, since they would capture every missing route.
+func (groups routeGroups) wrap(path string, params bool, handler RequestHandler) RequestHandler {
+	var (
+		longest *routeGroup
+		length  int
+	)
+
+	for _, g := range groups {
+		prefix := strings.TrimSuffix(g.fullPrefix(), "/")
+		if len(prefix) == 0 {
+			continue
+		}
+
+		if (longest == nil || len(prefix) > length) && hasGroupPrefix(path, prefix, params) {
+			longest, length = g, len(prefix)
+		}
+	}
+
+	if longest == nil {
+		return handler
+	}
+
+	return longest.wrapAll(handler)
+}
+
+//checks whether path is the group prefix, or a path under it. Pretty
+//prefixes are matched by segment: parameters match any segment, optional
+//ones may be missing, and wildcards match the rest of the path.
+func hasGroupPrefix(path, prefix string, params bool) bool {
+	if !params {
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+
+	path_segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	for i, segment := range strings.Split(prefix, "/") {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			return true
+		case i >= len(path_segments):
+			if !strings.HasSuffix(segment, "?") {
+				return false
+			}
+		case strings.HasPrefix(segment, ":"):
+			if len(path_segments[i]) == 0 {
+				return false
+			}
+		case segment != path_segments[i]:
+			return false
+		}
+	}
+
+	return true
+}
+
+//wraps the handler with the middleware of the group. The chain is built
+//when the handler runs, so that middleware added after the handler has been
+//registered still applies to it.
+func (g *routeGroup) wrap(handler RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		chain(g.middleware, handler)(w, r)
+	}
+}
+
+//routes the request using the mux of the group
+func (g *routeGroup) Route(w http.ResponseWriter, r *Request) {
+	g.mux.Route(w, r)
+}
+
+//registers a handler for a path relative to the group prefix
+func (g *routeGroup) Handle(method, path string, handler RequestHandler, name ...string) {
+	g.handle(method, path, handler, handler, name)
+}
+
+//wraps handler with the group's middleware and registers it on the group's
+//mux, which records origin as the handler defined by the user
+func (g *routeGroup) handle(method, path string, handler RequestHandler, origin interface{}, name []string) {
+	if registrar, ok := g.mux.(routeRegistrar); ok {
+		registrar.handle(method, g.prefix+path, g.wrap(handler), origin, name)
+		return
+	}
+
+	g.mux.Handle(method, g.prefix+path, g.wrap(handler), name...)
+}
+
+//registers a GET request handler
+func (g *routeGroup) Get(path string, handler RequestHandler, name ...string) {
+	g.Handle("GET", path, handler, name...)
+}
+
+//registers a POST request handler
+func (g *routeGroup) Post(path string, handler RequestHandler, name ...string) {
+	g.Handle("POST", path, handler, name...)
+}
+
+//registers a PUT request handler
+func (g *routeGroup) Put(path string, handler RequestHandler, name ...string) {
+	g.Handle("PUT", path, handler, name...)
+}
+
+//registers a DELETE request handler
+func (g *routeGroup) Delete(path string, handler RequestHandler, name ...string) {
+	g.Handle("DELETE", path, handler, name...)
+}
+
+//registers a PATCH request handler
+func (g *routeGroup) Patch(path string, handler RequestHandler, name ...string) {
+	g.Handle("PATCH", path, handler, name...)
+}
+
+//registers a HEAD request handler
+func (g *routeGroup) Head(path string, handler RequestHandler, name ...string) {
+	g.Handle("HEAD", path, handler, name...)
+}
+
+//registers a WebSocket endpoint
+func (g *routeGroup) WebSocket(path string, handler WebSocketHandler, name ...string) {
+	g.handle("GET", path, webSocketHandler(handler), handler, name)
+}
+
+//builds the path of a named route, using the mux of the group
+func (g *routeGroup) BuildPath(name string, params url.Values) (string, error) {
+	return g.mux.BuildPath(name, params)
+}
+
+//returns all routes of the group's mux
+func (g *routeGroup) Routes() []RouteInfo {
+	return g.mux.Routes()
+}
+
+//adds middleware to all routes of the group, including existing ones
+func (g *routeGroup) Use(middleware ...Middleware) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+//returns a sub-group whose prefix and middleware are appended to this group's
+func (g *routeGroup) Group(prefix string, middleware ...Middleware) Mux {
+	return newRouteGroup(g, prefix, middleware)
+}
+
+//sets the static path of the mux, relative to the group prefix
+func (g *routeGroup) Static(path string) {
+	g.mux.Static(g.prefix + path)
+}
+
+//sets the static path of the mux, relative to the group prefix, and the
+//file system that static files are served from
+func (g *routeGroup) StaticFS(path string, fsys fs.FS) {
+	g.mux.StaticFS(g.prefix+path, fsys)
+}
+
+//returns the server for static files of the mux
+func (g *routeGroup) StaticFiles() *StaticFiles {
+	return g.mux.StaticFiles()
+}
+
+func (g *routeGroup) StaticPrefix() string {
+	return g.mux.StaticPrefix()
+}
@@ -0,0 +1,162 @@
+package perfect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMux_Middleware(t *testing.T) {
+	var trace []string
+
+	record := func(name string) Middleware {
+		return func(handler RequestHandler) RequestHandler {
+			return func(w http.ResponseWriter, r *Request) {
+				trace = append(trace, name)
+				handler(w, r)
+			}
+		}
+	}
+
+	handler := func(name string) RequestHandler {
+		return func(w http.ResponseWriter, r *Request) {
+			trace = append(trace, name)
+		}
+	}
+
+	muxes := map[string]Mux{
+		"HTTPMux":   NewHTTPMux(),
+		"PrettyMux": NewPrettyMux(),
+	}
+
+	tests := []struct {
+		Method, Path string
+		Expected     []string
+	}{
+		{"GET", "/home", []string{"m1", "m2", "home"}},
+		{"GET", "/admin/users", []string{"m1", "m2", "admin", "late", "users"}},
+		{"GET", "/admin/forms/list", []string{"m1", "m2", "admin", "late", "forms", "list"}},
+		{"GET", "/missing", []string{"m1", "m2"}},
+		//responses for missing routes go through the middleware of the
+		//group with the longest prefix
+		{"GET", "/admin/missing", []string{"m1", "m2", "admin", "late"}},
+		{"GET", "/admin", []string{"m1", "m2", "admin", "late"}},
+		{"GET", "/administrator", []string{"m1", "m2"}},
+		{"DELETE", "/admin/users", []string{"m1", "m2", "admin", "late"}},
+		{"OPTIONS", "/admin/forms/list", []string{"m1", "m2", "admin", "late", "forms"}},
+		{"HEAD", "/admin/forms/list", []string{"m1", "m2", "admin", "late", "forms", "list"}},
+		{"GET", "/admin/forms/missing", []string{"m1", "m2", "admin", "late", "forms"}},
+		//groups without a prefix only wrap their own routes
+		{"GET", "/about", []string{"m1", "m2", "root", "about"}},
+		{"DELETE", "/about", []string{"m1", "m2"}},
+		{"GET", "/docs/missing", []string{"m1", "m2", "root", "docs"}},
+	}
+
+	for name, mux := range muxes {
+		mux.Use(record("m1"))
+		mux.Get("/home", handler("home"))
+
+		admin := mux.Group("/admin", record("admin"))
+		admin.Get("/users", handler("users"))
+
+		forms := admin.Group("/forms", record("forms"))
+		forms.Get("/list", handler("list"))
+
+		root := mux.Group("", record("root"))
+		root.Get("/about", handler("about"))
+		root.Group("/docs", record("docs"))
+		mux.Group("/", record("slash"))
+
+		//middleware added after the routes applies to them as well
+		admin.Use(record("late"))
+		mux.Use(record("m2"))
+
+		for _, test := range tests {
+			trace = nil
+
+			http_request := &http.Request{
+				Method: test.Method,
+				URL:    &url.URL{Path: test.Path},
+				Header: http.Header{},
+			}
+
+			request := NewRequest(http_request, test.Path, &Module{})
+			mux.Route(httptest.NewRecorder(), request)
+
+			if !reflect.DeepEqual(trace, test.Expected) {
+				t.Errorf("%v: %v %v ran %v, expected %v", name, test.Method, test.Path, trace, test.Expected)
+			}
+		}
+	}
+}
+
+func TestMux_MiddlewareShortCircuit(t *testing.T) {
+	called := false
+
+	deny := func(handler RequestHandler) RequestHandler {
+		return func(w http.ResponseWriter, r *Request) {
+			Unauthorized(w, r, ErrUnauthorized)
+		}
+	}
+
+	mux := NewPrettyMux()
+	mux.Get("/public", func(w http.ResponseWriter, r *Request) {})
+	mux.Group("/admin", deny).Get("/:page", func(w http.ResponseWriter, r *Request) {
+		called = true
+	})
+
+	http_request := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/admin/settings"},
+		Header: http.Header{},
+	}
+
+	response := httptest.NewRecorder()
+	mux.Route(response, NewRequest(http_request, "/admin/settings", &Module{}))
+
+	if called {
+		t.Errorf("the handler was called, expected the middleware to stop the request")
+	}
+
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("response.Code is %v, expected %v", response.Code, http.StatusUnauthorized)
+	}
+
+	//missing routes and methods don't reveal what the group handles
+	admin := mux.Group("/study/:study{[a-z]+}/admin", deny)
+	admin.Get("/users", func(w http.ResponseWriter, r *Request) {})
+	admin.Post("/users/:id", func(w http.ResponseWriter, r *Request) {})
+
+	tests := []struct {
+		Method, Path string
+		Status       int
+	}{
+		{"DELETE", "/study/abc/admin/users", http.StatusUnauthorized},
+		{"OPTIONS", "/study/abc/admin/users", http.StatusUnauthorized},
+		{"GET", "/study/abc/admin/users/1", http.StatusUnauthorized},
+		{"GET", "/study/abc/admin/missing/", http.StatusUnauthorized},
+		{"GET", "/study/abc/other", http.StatusNotFound},
+		{"DELETE", "/public", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		http_request := &http.Request{
+			Method: test.Method,
+			URL:    &url.URL{Path: test.Path},
+			Header: http.Header{},
+		}
+
+		response := httptest.NewRecorder()
+		mux.Route(response, NewRequest(http_request, test.Path, &Module{}))
+
+		if response.Code != test.Status {
+			t.Errorf("%v %v: response.Code is %v, expected %v", test.Method, test.Path, response.Code, test.Status)
+		}
+
+		if test.Status == http.StatusUnauthorized && len(response.Header().Get("Allow")) > 0 {
+			t.Errorf("%v %v: Allow is %v, expected none", test.Method, test.Path, response.Header().Get("Allow"))
+		}
+	}
+}
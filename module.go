@@ -1,21 +1,29 @@
 package perfect
 
 import (
-	"errors"
+	"fmt"
 	"github.com/vpetrov/perfect/orm"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	TEMPLATE_DIR = "templates"
 	TEMPLATE_EXT = ".html"
+
+	//the folders of layouts and partials, inside the templates folder
+	LAYOUT_DIR  = "layouts"
+	PARTIAL_DIR = "partials"
 )
 
 //A Perfect Module is a standalone component that can be mounted on
@@ -27,84 +35,421 @@ type Module struct {
 	Path           string
 	SessionTimeout time.Duration
 
+	//the largest request body the module accepts, in bytes. If 0,
+	//MAX_BODY_SIZE is used; if negative, bodies are not limited.
+	MaxBodySize int64
+
 	Db  orm.Database
 	Log *log.Logger
 
 	Templates *template.Template
+
+	//reloads templates when they change, and shows template errors in the
+	//browser. Otherwise, templates are only parsed by ParseTemplates.
+	Development bool
+
+	//reports template changes in development mode. If nil, the templates
+	//folder is polled every TEMPLATE_POLL_INTERVAL.
+	TemplateWatcher TemplateWatcher
+
+	//folders of partials shared between modules. Their templates are named
+	//'partials/<name>', and the module's own partials take precedence.
+	PartialDirs []string
+
+	templatesLock sync.RWMutex
+	templateSet   *templateSet
+	pages         map[string]*layoutPage
+	templateFuncs template.FuncMap
+	reloadLock    sync.Mutex
+	templateErr   error
+
+	//called after the module has been unmounted or swapped out, and all of
+	//its requests have finished, i.e. to disconnect from the database
+	OnClose func(m *Module) error
 }
 
 func (m *Module) abs(p string) string {
 	return m.MountPoint + p
 }
 
+//returns the URL of a static file, which is fingerprinted if the module has
+//an asset manifest (see BuildAssetManifest)
 func (m *Module) asset(p string) string {
-	return m.MountPoint + m.StaticPrefix() + p
+	prefix := m.StaticPrefix()
+
+	//modules without a static path have no manifest
+	if !m.Development && len(prefix) > 0 {
+		if manifest := m.StaticFiles().Manifest(); manifest != nil {
+			name := strings.TrimPrefix(p, "/")
+			if fingerprinted, ok := manifest.Lookup(name); ok {
+				p = p[:len(p)-len(name)] + fingerprinted
+			}
+		}
+	}
+
+	return m.MountPoint + prefix + p
 }
 
 func (m *Module) _string(i int) string {
 	return strconv.Itoa(i)
 }
 
-//parses all template files from the 'templates' folder of the module
+//returns the URL of a named route, including the module's mount point.
+//params is a list of key/value pairs: values of named parameters are
+//substituted in the route's path, and all others are added to the query
+//string, i.e. m.URL("form", "id", 1, "page", 2) -> /mount/form/1?page=2
+func (m *Module) URL(name string, params ...interface{}) (string, error) {
+	if len(params)%2 != 0 {
+		return "", fmt.Errorf("route '%s': odd number of parameters", name)
+	}
+
+	values := url.Values{}
+
+	for i := 0; i < len(params); i += 2 {
+		key, ok := params[i].(string)
+		if !ok {
+			return "", fmt.Errorf("route '%s': parameter name %v is not a string", name, params[i])
+		}
+		values.Add(key, fmt.Sprint(params[i+1]))
+	}
+
+	path, err := m.BuildPath(name, values)
+	if err != nil {
+		return "", err
+	}
+
+	//modules mounted on "/" have no prefix
+	result := strings.TrimSuffix(m.MountPoint, "/") + path
+
+	if len(values) > 0 {
+		result += "?" + values.Encode()
+	}
+
+	return result, nil
+}
+
+//parses all template files from the 'templates' folder of the module, and
+//the shared partials from PartialDirs
 func (m *Module) ParseTemplates() error {
 
 	log.Println("Parsing templates from", m.Path)
 
-	m.Templates = template.New(m.Name)
-	//set start/end tags (delimiters)
-	_ = m.Templates.Delims("<%", "%>")
+	if m.Development {
+		m.reloadLock.Lock()
+		defer m.reloadLock.Unlock()
+
+		//take note of the files before they are parsed, so that changes made
+		//while parsing are not missed
+		if _, err := m.templateWatcher().Changed(); err != nil {
+			log.Println("Failed to watch templates:", err)
+		}
+	}
+
+	templates, pages, err := m.parseTemplates()
+	m.setTemplates(templates, pages, err)
+
+	return err
+}
+
+//a template file, before it is parsed
+type templateSource struct {
+	name string
+	path string
+	text string
+	//the layout the template declares, if any
+	layout string
+}
 
-	pathlen := len(m.Path)
-	tpldirlen := len(TEMPLATE_DIR)
-	tplextlen := len(TEMPLATE_EXT)
+//matches the layout declaration at the start of a page, i.e.
+//	<% layout "main" %>
+var layoutPattern = regexp.MustCompile(`^\s*<%-?\s*layout\s+"([^"]+)"\s*-?%>`)
+
+//A page that is rendered with a layout. Each one has its own copy of the
+//module's templates, so that different pages can override the same blocks.
+type layoutPage struct {
+	set *templateSet
+	//the template that is executed, i.e. 'layouts/main'
+	layout string
+}
+
+//reads the template files in dir and its subfolders. Each template is named
+//after its path relative to dir, without the extension, i.e. 'users/list'.
+func readTemplates(dir, prefix string) ([]*templateSource, error) {
+	sources := []*templateSource{}
+
+	err := filepath.Walk(dir, func(currentPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			//modules don't need to have templates
+			if currentPath == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(currentPath) != TEMPLATE_EXT {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, currentPath)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(currentPath)
+		if err != nil {
+			return err
+		}
+
+		source := &templateSource{
+			name: prefix + filepath.ToSlash(strings.TrimSuffix(rel, TEMPLATE_EXT)),
+			path: currentPath,
+			text: string(data),
+		}
+
+		//layouts can't have layouts of their own
+		if match := layoutPattern.FindStringSubmatch(source.text); match != nil && !strings.HasPrefix(source.name, LAYOUT_DIR+"/") {
+			source.layout = LAYOUT_DIR + "/" + match[1]
+		}
+
+		sources = append(sources, source)
+
+		return nil
+	})
+
+	return sources, err
+}
+
+//Adds functions to the module's templates. Templates can only use the
+//functions that exist when they are parsed, so they must be added before
+//ParseTemplates. Functions replace the built-in ones with the same name,
+//except for those of the request: csrf, flash, partial, path, profile and
+//session.
+func (m *Module) AddTemplateFuncs(funcs template.FuncMap) {
+	m.templatesLock.Lock()
+	defer m.templatesLock.Unlock()
+
+	if m.templateFuncs == nil {
+		m.templateFuncs = template.FuncMap{}
+	}
+
+	for name, fn := range funcs {
+		m.templateFuncs[name] = fn
+	}
+}
+
+//returns a new set of templates, parsed from the 'templates' folder, and the
+//pages that have layouts, by name
+func (m *Module) parseTemplates() (*template.Template, map[string]*layoutPage, error) {
+	templates := template.New(m.Name)
+	//set start/end tags (delimiters)
+	_ = templates.Delims("<%", "%>")
 
 	moduleFuncs := map[string]interface{}{
 		"abs":    m.abs,
 		"asset":  m.asset,
 		"string": m._string,
+		"url":    m.URL,
+		//layouts are found before parsing, so the declaration renders nothing
+		"layout": func(string) string { return "" },
 	}
 
-	tplParser := func(currentPath string, info os.FileInfo, err error) error {
-		if !info.IsDir() && filepath.Ext(currentPath) == TEMPLATE_EXT {
-			//the template name is anything after 'path/templates/'
-			// '2' is for the 2 slashes in the path above
-			from := pathlen + tpldirlen + 2
-			to := len(currentPath) - tplextlen
-			requestPath := currentPath[from:to]
+	//functions must be defined before the templates that use them are parsed
+	templates.Funcs(moduleFuncs)
+	m.templatesLock.RLock()
+	templates.Funcs(m.templateFuncs)
+	m.templatesLock.RUnlock()
+	templates.Funcs((&renderSet{}).funcs())
 
-			//read the template file
-			data, err := ioutil.ReadFile(currentPath)
-			if err != nil {
-				return err
-			}
+	//shared partials come first, so that the module's own partials replace them
+	sources := []*templateSource{}
+	for _, dir := range m.PartialDirs {
+		partials, err := readTemplates(dir, PARTIAL_DIR+"/")
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, partials...)
+	}
 
-			t, err := m.Templates.New(requestPath).Parse(string(data))
-			if err != nil {
-				return err
-			}
+	own, err := readTemplates(filepath.Join(m.Path, TEMPLATE_DIR), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	sources = append(sources, own...)
 
-			t.Funcs(moduleFuncs)
+	//layouts, partials and pages without a layout share one set
+	for _, source := range sources {
+		if len(source.layout) > 0 {
+			continue
 		}
 
-		return nil
+		if _, err := templates.New(source.name).Parse(source.text); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", source.path, err)
+		}
 	}
 
-	err := filepath.Walk(m.Path, tplParser)
+	//pages with a layout are parsed into copies of it, so that the blocks
+	//they define replace those of the layout only for themselves
+	pages := map[string]*layoutPage{}
+	for _, source := range sources {
+		if len(source.layout) == 0 {
+			continue
+		}
 
-	return err
+		if templates.Lookup(source.layout) == nil {
+			return nil, nil, fmt.Errorf("%s: no such layout '%s'", source.path, source.layout)
+		}
+
+		page, err := templates.Clone()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, err := page.New(source.name).Parse(source.text); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", source.path, err)
+		}
+
+		pages[source.name] = &layoutPage{set: newTemplateSet(page), layout: source.layout}
+	}
+
+	return templates, pages, nil
 }
 
-// renders a template file
-func (m *Module) RenderTemplate(w http.ResponseWriter, r *Request, path string, data interface{}) {
-	tpl := m.Templates.Lookup(path)
-	if tpl == nil {
-		Error(w, r, errors.New("Template not found: "+path))
+//replaces the templates of the module. Renders in progress keep using the
+//templates they started with.
+func (m *Module) setTemplates(templates *template.Template, pages map[string]*layoutPage, err error) {
+	m.templatesLock.Lock()
+	defer m.templatesLock.Unlock()
+
+	m.templateErr = err
+	//production modules keep the templates that were parsed, as before
+	if err == nil || !m.Development {
+		m.Templates = templates
+		m.templateSet = newTemplateSet(templates)
+		m.pages = pages
+	}
+}
+
+//returns the watcher of a development module, creating it if needed
+func (m *Module) templateWatcher() TemplateWatcher {
+	if m.TemplateWatcher == nil {
+		dirs := append([]string{filepath.Join(m.Path, TEMPLATE_DIR)}, m.PartialDirs...)
+		m.TemplateWatcher = NewPollingWatcher(TEMPLATE_EXT, TEMPLATE_POLL_INTERVAL, dirs...)
+	}
+
+	return m.TemplateWatcher
+}
+
+//parses the templates again if they changed
+func (m *Module) reloadTemplates() {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	changed, err := m.templateWatcher().Changed()
+	if err != nil {
+		log.Println("Failed to watch templates:", err)
+		return
+	}
+
+	if !changed {
 		return
 	}
 
-	err := tpl.Execute(w, data)
+	log.Println("Reloading templates from", m.Path)
+
+	templates, pages, err := m.parseTemplates()
+	if err != nil {
+		log.Println("Failed to parse templates:", err)
+	}
+
+	m.setTemplates(templates, pages, err)
+}
+
+//returns the set that has the template called name, and the template that
+//renders it: pages with a layout are rendered by the layout, with the
+//page's blocks. Returns a nil set if there is no such template.
+//Development modules reload their templates first, if they changed, and
+//return the error if they couldn't be parsed.
+func (m *Module) findTemplate(name string) (*templateSet, string, error) {
+	if m.Development {
+		m.reloadTemplates()
+	}
+
+	m.templatesLock.RLock()
+	set, templates, pages, err := m.templateSet, m.Templates, m.pages, m.templateErr
+	m.templatesLock.RUnlock()
+
+	if err != nil && m.Development {
+		return nil, "", err
+	}
+
+	if page, ok := pages[name]; ok {
+		return page.set, page.layout, nil
+	}
+
+	if templates == nil || templates.Lookup(name) == nil {
+		return nil, "", nil
+	}
+
+	//Templates can be set directly, i.e. by tests
+	if set == nil || set.templates != templates {
+		m.templatesLock.Lock()
+		if m.templateSet == nil || m.templateSet.templates != m.Templates {
+			m.templateSet = newTemplateSet(m.Templates)
+		}
+		set = m.templateSet
+		m.templatesLock.Unlock()
+	}
+
+	return set, name, nil
+}
+
+//renders a template with 200 OK
+func (m *Module) RenderTemplate(w http.ResponseWriter, r *Request, path string, data interface{}) {
+	m.RenderTemplateStatus(w, r, http.StatusOK, path, data)
+}
+
+//Renders a template with the given status code. The page is only sent once
+//it has been rendered completely; if the template is missing or fails, the
+//client receives an error response instead (see Error). The Content-Type
+//is text/html, unless the handler has set another one.
+func (m *Module) RenderTemplateStatus(w http.ResponseWriter, r *Request, status int, path string, data interface{}) {
+	set, name, err := m.findTemplate(path)
 	if err != nil {
-		LogError(r, err)
+		m.templateError(w, r, err)
+		return
+	}
+
+	if set == nil {
+		Error(w, r, fmt.Errorf("%w: %s", ErrNoSuchTemplate, path))
+		return
+	}
+
+	if err := set.render(w, r, name, status, data); err != nil {
+		m.templateError(w, r, err)
+	}
+}
+
+//the page that shows template errors in development mode
+var templateErrorPage = template.Must(template.New("template error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Template error</title></head>
+<body>
+<h1>Template error</h1>
+<pre>{{.}}</pre>
+</body>
+</html>
+`))
+
+//shows a template error in development mode; otherwise responds like Error
+func (m *Module) templateError(w http.ResponseWriter, r *Request, err error) {
+	if !m.Development || wantsJSON(r) {
+		Error(w, r, err)
 		return
 	}
+
+	LogError(r, err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	templateErrorPage.Execute(w, err.Error())
 }
@@ -1,30 +1,71 @@
 package perfect
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"runtime/debug"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
 
-//TODO: remove this or make it configurable
-const GITHUB_URL = "https://api.github.com/repos/vpetrov/survana/issues?access_token=a8202d411154a49dab3a42b6e46fc51549ce651a"
-
 //decides which Module handles which Request
 type ModuleMux struct {
 	lock    sync.RWMutex
-	modules map[string]*Module
+	modules map[string]*mountedModule
+	root    *mountNode //modules mounted on all hosts
+
+	//virtual hosts
+	hosts          map[string]*mountNode
+	wildcards      []*wildcardHost
+	trustedProxies []*net.IPNet
+
+	panicReporter PanicReporter
+}
+
+//A module mounted on a path, along with the requests it's serving.
+//A new mountedModule is created every time a module is mounted, so that
+//requests in flight are always counted against the right mount.
+type mountedModule struct {
+	*Module
+	requests sync.WaitGroup
+}
+
+//waits for all requests in flight to finish, then runs the module's close
+//hook. If ctx is done first, the close hook still runs, and ctx's error is
+//returned.
+func (mm *mountedModule) close(ctx context.Context) (err error) {
+	done := make(chan struct{})
+
+	go func() {
+		mm.requests.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Println("Timed out waiting for requests to", mm.Name, "to finish:", err)
+	}
+
+	if mm.OnClose != nil {
+		if close_err := mm.OnClose(mm.Module); close_err != nil && err == nil {
+			err = close_err
+		}
+	}
+
+	return
 }
 
 //Returns a new ModuleMux
 func NewModuleMux() *ModuleMux {
 	return &ModuleMux{
-		modules: make(map[string]*Module, 0),
+		modules: make(map[string]*mountedModule, 0),
+		root:    &mountNode{},
+		hosts:   make(map[string]*mountNode, 0),
 	}
 }
 
@@ -32,93 +73,69 @@ func NewModuleMux() *ModuleMux {
 func (mux *ModuleMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
-	//detect which module this request should go to
-	mount_point, rurl := mux.GetModule(r.URL.Path)
+	var (
+		mounted *mountedModule
+		rurl    string
+	)
 
-	//lock modules mutex for reading (ensures that the map won't be changed
+	//lock modules mutex for reading (ensures that the tree won't be changed
 	//while we're reading from it)
 	mux.lock.RLock()
-	//fetch the module
-	module, ok := mux.modules[mount_point]
+	//detect which module this request should go to: first by host, then by
+	//path. Falls back to the modules mounted on all hosts, and finally to the
+	//"/" module if no other module matches.
+	root, host_key, host_label := mux.findHost(mux.requestHost(r))
+	client_ip := mux.clientIP(r)
+	if root != nil {
+		mounted, _, rurl = root.find(r.URL.Path)
+	}
+	if mounted == nil {
+		host_key = ""
+		mounted, _, rurl = mux.root.find(r.URL.Path)
+	}
+	//count the request while the lock is held, so that Unmount and Swap
+	//can't miss it
+	if mounted != nil {
+		mounted.requests.Add(1)
+	}
 	mux.lock.RUnlock()
 
-	if !ok {
-		//fetch the "/" module
-		mux.lock.RLock()
-		module, ok = mux.modules["/"]
-		mux.lock.RUnlock()
-		// if no default module found, return a 500 Internal Server Error
-		if !ok {
-			http.Error(w,
-				"Internal Server Error",
-				http.StatusInternalServerError)
-			return
-		}
+	// if no default module found, return a 500 Internal Server Error
+	if mounted == nil {
+		http.Error(w,
+			"Internal Server Error",
+			http.StatusInternalServerError)
+		return
 	}
 
+	//runs last, after any panics have been reported
+	defer mounted.requests.Done()
+
+	module := mounted.Module
+
 	//create an application-specific request object
 	request := NewRequest(r, rurl, module)
+	request.clientIP = client_ip
+
+	//store the label matched by a wildcard host first, like path parameters
+	if len(host_key) > 0 {
+		request.Values[host_key] = append([]string{host_label}, request.Values[host_key]...)
+	}
 
-	//report panics as issues on Github (with debug info)
+	//recover from panics: log them, send a clean 500 Internal Server Error
+	//to the client, and report them in the background
 	defer func() {
-		if r_err := recover(); r_err != nil {
-
-			var error_string string
-
-			switch c := r_err.(type) {
-			case string:
-				error_string = c
-			case error:
-				error_string = c.Error()
-			default:
-				error_string = "unknown error object"
-			}
-
-			//convert the http request to a json string
-			json_request, err := json.MarshalIndent(request, "  ", "")
-			if err != nil {
-				log.Println("DEBUG: Failed to encode request as JSON:", err)
-				panic(r_err)
-			}
-			//create the report: error, stack, request
-			report := &GithubIssue{
-				Title:  "Automatic Panic Report (" + module.Name + ")",
-				Body:   error_string + "\n\n Stack:\n" + string(debug.Stack()) + "\n\n Request:\n" + string(json_request),
-				Labels: []string{"auto", "panic", module.Name},
-			}
-
-			//convert the report to JSON
-			json_report, err := json.Marshal(report)
-			buf := bytes.NewBuffer(json_report)
-			github_response, err := http.Post(GITHUB_URL, "application/json", buf)
-			if err != nil {
-				log.Println("DEBUG: Failed to create new GitHub issue:", err)
-				panic(r_err)
-			}
-
-			json_response, err := ioutil.ReadAll(github_response.Body)
-			if err != nil {
-				log.Println("DEBUG: Failed to read GitHub's response:", err)
-				panic(r_err)
-			}
-
-			response := &GithubResponse{}
-			//read Github's reply
-			err = json.Unmarshal(json_response, response)
-			if err != nil {
-				log.Println("DEBUG: Failed to read reply from Github:", err)
-				panic(r_err)
-			}
-
-			//set issue info as special headers
-			if response.IssueNumber > 0 {
-				w.Header().Set("X-Survana-IssueNumber", string(response.IssueNumber))
-				w.Header().Set("X-Survana-IssueUrl", response.HtmlUrl)
-			}
-
-			//send the original error to the client
-			Error(w, request, r_err.(error))
+		r_err := recover()
+		if r_err == nil {
+			return
 		}
+
+		//handlers panic with ErrAbortHandler to abort the response on purpose
+		if r_err == http.ErrAbortHandler {
+			panic(r_err)
+		}
+
+		mux.recovered(w, request, r_err)
 	}()
 
 	//route the request
@@ -129,48 +146,188 @@ func (mux *ModuleMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//Registers a new Module for a URL path
-func (mux *ModuleMux) Mount(m *Module, path string) {
+//Registers a new Module for a URL path. Mount points can have multiple
+//segments (i.e. /api/v2) and can be nested inside other mount points; each
+//request goes to the module with the longest matching mount point.
+//Mount points can also start with a host pattern, in which case the module
+//only handles requests for that host, i.e. admin.example.com/ or
+//*.tenant.example.com/api. The leftmost label of a host pattern can be a
+//wildcard; its value is stored in Request.Values, under SUBDOMAIN for '*',
+//or under 'name' for ':name'.
+//Returns an error if the path is not a valid mount point, if another module
+//has already been mounted on it, or if the module is already mounted.
+func (mux *ModuleMux) Mount(m *Module, path string) error {
+	host, mpath := splitMountPoint(path)
+
+	err := checkHostPattern(host)
+	if err != nil {
+		return err
+	}
+
+	err = checkMountPoint(mpath)
+	if err != nil {
+		return err
+	}
+
+	key := host + mpath
+
 	//atempt to lock the modules mutex before we write to the map
 	mux.lock.Lock()
-	// add the module pointer to the map
-	mux.modules[path] = m
-	// unlock the mutex
-	mux.lock.Unlock()
+	defer mux.lock.Unlock()
+
+	if other, ok := mux.modules[key]; ok {
+		return fmt.Errorf("%s: '%s' is already mounted on '%s'", ErrMountConflict, other.Name, key)
+	}
+
+	for p, other := range mux.modules {
+		if other.Module == m {
+			return fmt.Errorf("%s: '%s' is already mounted on '%s'", ErrMountConflict, m.Name, p)
+		}
+	}
+
+	root := mux.hostRoot(host, true)
+	if root == nil {
+		return fmt.Errorf("%s: '%s' uses a different wildcard than other modules on the same host", ErrMountConflict, key)
+	}
 
-	log.Println("Mounting ", m.Name, "on", path)
+	// add the module pointer to the map and the tree
+	mounted := &mountedModule{Module: m}
+	mux.modules[key] = mounted
+	root.lookup(mpath, true).module = mounted
 
-	m.MountPoint = path
+	log.Println("Mounting ", m.Name, "on", key)
+
+	m.MountPoint = mpath
+
+	return nil
 }
 
-//Unregisters the module that handles the path
-func (mux *ModuleMux) Unmount(path string) {
+//Unregisters the module that handles the path. New requests stop going to
+//the module immediately, while requests in flight are given until ctx is
+//done to finish. The module's OnClose hook runs afterwards.
+func (mux *ModuleMux) Unmount(path string, ctx context.Context) error {
+	host, mpath := splitMountPoint(path)
+	key := host + mpath
+
 	mux.lock.Lock()
+	mounted, ok := mux.modules[key]
+	if !ok {
+		mux.lock.Unlock()
+		return fmt.Errorf("%s '%s'", ErrNotMounted, path)
+	}
 	//remove the module from the path
-	delete(mux.modules, path)
+	delete(mux.modules, key)
+	mux.hostRoot(host, false).remove(mpath)
+	mux.pruneHost(host)
 	mux.lock.Unlock()
+
+	log.Println("Unmounting", mounted.Name, "from", key)
+
+	return mounted.close(ctx)
 }
 
-// searches for a module by the path it's been mounted on
-func (mux *ModuleMux) GetModule(path string) (module, mpath string) {
+//Atomically replaces the module mounted on path with m. New requests go to
+//m immediately, while requests in flight are given until ctx is done to
+//finish in the old module. The old module's OnClose hook runs afterwards.
+func (mux *ModuleMux) Swap(path string, m *Module, ctx context.Context) error {
+	host, mpath := splitMountPoint(path)
+	key := host + mpath
+
+	mux.lock.Lock()
+	old, ok := mux.modules[key]
+	if !ok {
+		mux.lock.Unlock()
+		return fmt.Errorf("%s '%s'", ErrNotMounted, path)
+	}
 
-	if len(path) <= 1 {
-		return "/", path
+	for p, other := range mux.modules {
+		if other.Module == m {
+			mux.lock.Unlock()
+			return fmt.Errorf("%s: '%s' is already mounted on '%s'", ErrMountConflict, m.Name, p)
+		}
 	}
 
-	// find the second "/" in path
-	slash := strings.Index(path[1:], "/") + 1
+	mounted := &mountedModule{Module: m}
+	mux.modules[key] = mounted
+	mux.hostRoot(host, false).lookup(mpath, false).module = mounted
+	m.MountPoint = mpath
+	mux.lock.Unlock()
+
+	log.Println("Swapping", old.Name, "for", m.Name, "on", key)
+
+	return old.close(ctx)
+}
 
-	//if no slashes were found, return original path and default module
-	if slash == 0 {
-		return "/", path
+//returns the routes of all mounted modules, sorted by mount point
+func (mux *ModuleMux) Routes() []RouteInfo {
+	mux.lock.RLock()
+	defer mux.lock.RUnlock()
+
+	mount_points := make([]string, 0, len(mux.modules))
+	for mount_point := range mux.modules {
+		mount_points = append(mount_points, mount_point)
 	}
 
-	// the module is the first item between the 2 slashes
-	module = path[:slash]
+	sort.Strings(mount_points)
+
+	routes := make([]RouteInfo, 0)
+
+	for _, mount_point := range mount_points {
+		module := mux.modules[mount_point]
+		if module.Mux == nil {
+			continue
+		}
 
-	// the module's URL 'path' is everything that follows it
-	mpath = path[slash:]
+		for _, route := range module.Routes() {
+			route.MountPoint = mount_point
+			routes = append(routes, route)
+		}
+	}
+
+	return routes
+}
+
+//Sets the reporter that is notified of panics in request handlers. Panics
+//are always logged; reporter can be nil to disable reporting.
+//Wrap reporters with NewThrottledReporter to avoid sending the same report
+//over and over again.
+func (mux *ModuleMux) SetPanicReporter(reporter PanicReporter) {
+	mux.lock.Lock()
+	mux.panicReporter = reporter
+	mux.lock.Unlock()
+}
+
+//handles a panic recovered from a request handler. Must be called from the
+//deferred function that recovered it, so that the stack can be captured.
+func (mux *ModuleMux) recovered(w http.ResponseWriter, r *Request, r_err interface{}) {
+	//skip runtime.Callers, panicStack, recovered, the deferred function and
+	//runtime.gopanic
+	stack, fingerprint := panicStack(5)
+	report := newPanicReport(r, r_err, stack, fingerprint)
+
+	log.Printf("PANIC in %s [%s]: %s\n%s", report.Module, fingerprint, report.Error, stack)
+	if r.Module.Log != nil {
+		r.Module.Log.Printf("PANIC [%s]: %s\n%s", fingerprint, report.Error, stack)
+	}
+
+	writeErrorPage(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+
+	mux.lock.RLock()
+	reporter := mux.panicReporter
+	mux.lock.RUnlock()
+
+	if reporter != nil {
+		go sendPanicReport(reporter, report)
+	}
+}
+
+// searches for a module by the path it's been mounted on. Returns the mount
+// point of the module that handles path, and the path relative to it.
+// Only modules mounted on all hosts are considered.
+func (mux *ModuleMux) GetModule(path string) (module, mpath string) {
+	mux.lock.RLock()
+	_, module, mpath = mux.root.find(path)
+	mux.lock.RUnlock()
 
 	return
 }
@@ -1,10 +1,12 @@
 package perfect
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestModuleMux(t *testing.T) {
@@ -26,3 +28,192 @@ func TestModuleMux(t *testing.T) {
 
 	t.Logf("body = %s", body)
 }
+
+func TestModuleMux_Mount(t *testing.T) {
+	mux := NewModuleMux()
+
+	modules := map[string]*Module{}
+	for _, path := range []string{"/", "/api", "/api/v1", "/api/v2", "/study/forms"} {
+		modules[path] = &Module{Name: path, Mux: NewHTTPMux()}
+		if err := mux.Mount(modules[path], path); err != nil {
+			t.Fatalf("Mount(%v): err = %v", path, err)
+		}
+	}
+
+	tests := []struct {
+		Path, MountPoint, Rest string
+	}{
+		{"/", "/", "/"},
+		{"/login", "/", "/login"},
+		{"/api", "/api", "/"},
+		{"/api/", "/api", "/"},
+		{"/api/v3/forms", "/api", "/v3/forms"},
+		{"/api/v1/forms/1", "/api/v1", "/forms/1"},
+		{"/api/v2", "/api/v2", "/"},
+		{"/api/v2x/forms", "/api", "/v2x/forms"},
+		{"/study", "/", "/study"},
+		{"/study/forms/1", "/study/forms", "/1"},
+	}
+
+	for _, test := range tests {
+		mount_point, rest := mux.GetModule(test.Path)
+		if mount_point != test.MountPoint || rest != test.Rest {
+			t.Errorf("GetModule(%v) is (%v, %v), expected (%v, %v)", test.Path, mount_point, rest, test.MountPoint, test.Rest)
+		}
+	}
+
+	//invalid mount points and conflicts
+	invalid := []string{"", "api", "/api/", "//api", "/api//v3", "/api/../v3", "/study/:id", "/api/v1"}
+	for _, path := range invalid {
+		if err := mux.Mount(&Module{Mux: NewHTTPMux()}, path); err == nil {
+			t.Errorf("Mount(%v) succeeded, expected an error", path)
+		}
+	}
+
+	if err := mux.Mount(modules["/api"], "/api/v3"); err == nil {
+		t.Errorf("mounting the same module twice succeeded, expected an error")
+	}
+
+	//unmounting a nested module falls back to its parent
+	mux.Unmount("/api/v1", context.Background())
+	if mount_point, rest := mux.GetModule("/api/v1/forms"); mount_point != "/api" || rest != "/v1/forms" {
+		t.Errorf("GetModule(/api/v1/forms) is (%v, %v), expected (/api, /v1/forms)", mount_point, rest)
+	}
+
+	mux.Unmount("/study/forms", context.Background())
+	if _, ok := mux.root.children["study"]; ok {
+		t.Errorf("unmounting /study/forms did not remove the empty nodes")
+	}
+}
+
+func TestModuleMux_ServeHTTP(t *testing.T) {
+	mux := NewModuleMux()
+
+	for _, path := range []string{"/", "/api/v2"} {
+		module := &Module{Name: path, Mux: NewHTTPMux()}
+		mount_point := path
+		module.Get("/users", func(w http.ResponseWriter, r *Request) {
+			w.Write([]byte(mount_point + " " + r.URL.Path))
+		})
+		mux.Mount(module, path)
+	}
+
+	tests := map[string]string{
+		"/users":        "/ /users",
+		"/api/v2/users": "/api/v2 /users",
+	}
+
+	for path, expected := range tests {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+
+		mux.ServeHTTP(response, request)
+
+		if response.Body.String() != expected {
+			t.Errorf("%v body is '%v', expected '%v'", path, response.Body.String(), expected)
+		}
+	}
+}
+
+func TestModuleMux_Swap(t *testing.T) {
+	mux := NewModuleMux()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	closed := make(chan string, 2)
+
+	newModule := func(name string) *Module {
+		module := &Module{
+			Name: name,
+			Mux:  NewHTTPMux(),
+			OnClose: func(m *Module) error {
+				closed <- m.Name
+				return nil
+			},
+		}
+
+		module.Get("/slow", func(w http.ResponseWriter, r *Request) {
+			started <- true
+			<-release
+			w.Write([]byte(name))
+		})
+
+		module.Get("/name", func(w http.ResponseWriter, r *Request) {
+			w.Write([]byte(name))
+		})
+
+		return module
+	}
+
+	get := func(path string) string {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		mux.ServeHTTP(response, request)
+		return response.Body.String()
+	}
+
+	mux.Mount(newModule("v1"), "/app")
+
+	//start a slow request on v1
+	slow := make(chan string)
+	go func() {
+		slow <- get("/app/slow")
+	}()
+	<-started
+
+	swapped := make(chan error)
+	go func() {
+		swapped <- mux.Swap("/app", newModule("v2"), context.Background())
+	}()
+
+	//new requests must go to v2 while v1 is still draining
+	for get("/app/name") != "v2" {
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-swapped:
+		t.Fatalf("Swap returned %v before the request in flight finished", err)
+	case name := <-closed:
+		t.Fatalf("%v was closed before its request in flight finished", name)
+	default:
+	}
+
+	release <- true
+
+	if body := <-slow; body != "v1" {
+		t.Errorf("request in flight body is '%v', expected 'v1'", body)
+	}
+
+	if err := <-swapped; err != nil {
+		t.Errorf("err = %v", err)
+	}
+
+	if name := <-closed; name != "v1" {
+		t.Errorf("closed module is %v, expected v1", name)
+	}
+
+	//unmount with a request in flight that outlives the timeout
+	go func() {
+		slow <- get("/app/slow")
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := mux.Unmount("/app", ctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	if name := <-closed; name != "v2" {
+		t.Errorf("closed module is %v, expected v2", name)
+	}
+
+	release <- true
+	<-slow
+
+	if err := mux.Unmount("/app", context.Background()); err == nil {
+		t.Errorf("unmounting an empty path succeeded, expected an error")
+	}
+}
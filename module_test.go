@@ -1,9 +1,15 @@
 package perfect
 
 import (
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -32,3 +38,219 @@ func TestModule_Mux(t *testing.T) {
 	t.Logf("body = %s", body)
 
 }
+
+func TestModule_URL(t *testing.T) {
+	mux := NewPrettyMux()
+	handler := func(w http.ResponseWriter, r *Request) {}
+
+	mux.Get("/", handler, "home")
+	mux.Get("/study/:study/form/:form", handler, "form")
+	mux.Get("/users/:id{[0-9]+}", handler, "user")
+	mux.Get("/files/*path", handler, "files")
+	mux.Get("/archive/:year?/:month?", handler, "archive")
+
+	module := &Module{
+		Mux:        mux,
+		MountPoint: "/test",
+	}
+
+	tests := []struct {
+		Name     string
+		Params   []interface{}
+		Expected string
+	}{
+		{"home", nil, "/test/"},
+		{"form", []interface{}{"study", "A", "form", 1}, "/test/study/A/form/1"},
+		{"form", []interface{}{"form", "b c", "study", "A", "page", 2}, "/test/study/A/form/b%20c?page=2"},
+		{"user", []interface{}{"id", 42}, "/test/users/42"},
+		{"files", []interface{}{"path", "css/app.css"}, "/test/files/css/app.css"},
+		{"archive", nil, "/test/archive"},
+		{"archive", []interface{}{"year", 2014}, "/test/archive/2014"},
+	}
+
+	for _, test := range tests {
+		actual, err := module.URL(test.Name, test.Params...)
+		if err != nil {
+			t.Errorf("%v: err = %v", test.Name, err)
+			continue
+		}
+
+		if actual != test.Expected {
+			t.Errorf("URL(%v, %v) is %v, expected %v", test.Name, test.Params, actual, test.Expected)
+		}
+	}
+
+	errors := []struct {
+		Name   string
+		Params []interface{}
+	}{
+		{"missing", nil},
+		{"form", []interface{}{"study", "A"}},
+		{"form", []interface{}{"study"}},
+		{"form", []interface{}{1, "A"}},
+		{"user", []interface{}{"id", "bob"}},
+	}
+
+	for _, test := range errors {
+		if actual, err := module.URL(test.Name, test.Params...); err == nil {
+			t.Errorf("URL(%v, %v) is %v, expected an error", test.Name, test.Params, actual)
+		}
+	}
+
+	//the root module has no prefix
+	module.MountPoint = "/"
+	if actual, _ := module.URL("user", "id", 1); actual != "/users/1" {
+		t.Errorf("URL(user) is %v, expected /users/1", actual)
+	}
+
+	//names must be unique
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("registering a duplicate route name did not panic")
+		}
+	}()
+
+	mux.Post("/form", handler, "form")
+}
+
+func TestModule_URLTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perfect")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, TEMPLATE_DIR), 0755)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, TEMPLATE_DIR, "page.html"), []byte(`<a href="<% url "user" "id" .Id %>">`), 0644)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	mux := NewPrettyMux()
+	mux.Get("/users/:id", func(w http.ResponseWriter, r *Request) {}, "user")
+
+	module := &Module{
+		Mux:        mux,
+		Path:       dir,
+		MountPoint: "/test",
+	}
+
+	err = module.ParseTemplates()
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	response := httptest.NewRecorder()
+	module.RenderTemplate(response, &Request{Module: module}, "page", map[string]int{"Id": 7})
+
+	expected := `<a href="/test/users/7">`
+	if response.Body.String() != expected {
+		t.Errorf("body is %v, expected %v", response.Body.String(), expected)
+	}
+}
+
+func TestModule_AddTemplateFuncs(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{
+		"page": `<% upper .Name %> <% asset "/app.js" %>`,
+	})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "funcs", Mux: NewPrettyMux(), Path: dir, MountPoint: "/test"}
+	module.AddTemplateFuncs(template.FuncMap{
+		"upper": strings.ToUpper,
+		//built-in functions can be replaced
+		"asset": func(p string) string { return "https://cdn.example.com" + p },
+	})
+
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	expected := "BOB https://cdn.example.com/app.js"
+	if response := renderTemplate(module, "page", map[string]string{"Name": "bob"}); response.Body.String() != expected {
+		t.Errorf("body = %q, expected %q", response.Body.String(), expected)
+	}
+}
+
+func BenchmarkModule_RenderTemplate(b *testing.B) {
+	templates := map[string]string{"page": `<p><% .Name %> at <% path %></p>`}
+	for i := 0; i < 50; i++ {
+		templates["pages/"+strconv.Itoa(i)] = `<div><% .Name %></div>`
+	}
+
+	dir := newTemplateTestDir(b, templates)
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "bench", Mux: NewPrettyMux(), Path: dir}
+	if err := module.ParseTemplates(); err != nil {
+		b.Fatalf("err = %v", err)
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost/page", nil)
+	r := NewRequest(request, "/page", module)
+	data := map[string]string{"Name": "bob"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		response := httptest.NewRecorder()
+		module.RenderTemplate(response, r, "page", data)
+
+		if response.Code != http.StatusOK {
+			b.Fatalf("status = %v, body = %q", response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestModule_RenderTemplate_Concurrent(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{
+		"page":          `<% path %>:<% partial "item" . %>`,
+		"partials/item": `<% path %>=<% . %>`,
+		ERROR_TEMPLATE:  `<% path %> <% .Status %>`,
+	})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "concurrent", Mux: NewPrettyMux(), Path: dir}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	//the copies of the templates are shared between requests, but every
+	//render sees its own request
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			path := "/" + strconv.Itoa(i)
+			request, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+			r := NewRequest(request, path, module)
+
+			for j := 0; j < 50; j++ {
+				response := httptest.NewRecorder()
+				module.RenderTemplate(response, r, "page", j)
+
+				if expected := path + ":" + path + "=" + strconv.Itoa(j); response.Body.String() != expected {
+					t.Errorf("body = %q, expected %q", response.Body.String(), expected)
+					return
+				}
+
+				response = httptest.NewRecorder()
+				NotFound(response, r)
+
+				if expected := path + " 404"; response.Body.String() != expected {
+					t.Errorf("body = %q, expected %q", response.Body.String(), expected)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
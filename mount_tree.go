@@ -0,0 +1,136 @@
+package perfect
+
+import (
+	"fmt"
+	"strings"
+)
+
+//a node in the tree of mount points used by ModuleMux. Each node represents
+//one path segment; the root node is the "/" mount point.
+type mountNode struct {
+	children map[string]*mountNode
+	module   *mountedModule
+}
+
+//returns an error if path can't be used as a mount point. Mount points
+//must start with a slash, and can't have empty, relative or parameter
+//segments, or a trailing slash (except for "/").
+func checkMountPoint(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s '%s': must start with '/'", ErrInvalidMountPoint, path)
+	}
+
+	if path == "/" {
+		return nil
+	}
+
+	for _, segment := range strings.Split(path[1:], "/") {
+		switch {
+		case len(segment) == 0:
+			return fmt.Errorf("%s '%s': empty path segment", ErrInvalidMountPoint, path)
+		case segment == "." || segment == "..":
+			return fmt.Errorf("%s '%s': relative path segment", ErrInvalidMountPoint, path)
+		case strings.ContainsAny(segment, ":*?#"):
+			return fmt.Errorf("%s '%s': invalid character in '%s'", ErrInvalidMountPoint, path, segment)
+		}
+	}
+
+	return nil
+}
+
+//returns the node for a valid mount point, creating it if create is true
+func (n *mountNode) lookup(path string, create bool) *mountNode {
+	if path == "/" {
+		return n
+	}
+
+	node := n
+
+	for _, segment := range strings.Split(path[1:], "/") {
+		child, ok := node.children[segment]
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			if node.children == nil {
+				node.children = make(map[string]*mountNode)
+			}
+
+			child = &mountNode{}
+			node.children[segment] = child
+		}
+
+		node = child
+	}
+
+	return node
+}
+
+//removes the module mounted on path, along with any nodes left empty
+func (n *mountNode) remove(path string) {
+	if path == "/" {
+		n.module = nil
+		return
+	}
+
+	segments := strings.Split(path[1:], "/")
+	nodes := make([]*mountNode, 0, len(segments)+1)
+	nodes = append(nodes, n)
+
+	for _, segment := range segments {
+		child, ok := nodes[len(nodes)-1].children[segment]
+		if !ok {
+			return
+		}
+		nodes = append(nodes, child)
+	}
+
+	nodes[len(nodes)-1].module = nil
+
+	//prune empty nodes, from the leaf up
+	for i := len(nodes) - 1; i > 0; i-- {
+		if nodes[i].module != nil || len(nodes[i].children) > 0 {
+			break
+		}
+		delete(nodes[i-1].children, segments[i-1])
+	}
+}
+
+//finds the module with the longest mount point that is a prefix of path,
+//on segment boundaries. Returns the module, its mount point, and the rest
+//of the path, which is relative to the mount point.
+//The module mounted on "/" (if any) is the fallback.
+func (n *mountNode) find(path string) (module *mountedModule, mount, rest string) {
+	module, mount, rest = n.module, "/", path
+
+	node := n
+	i := 0
+
+	for i < len(path) && path[i] == '/' {
+		end := strings.IndexByte(path[i+1:], '/')
+		if end < 0 {
+			end = len(path)
+		} else {
+			end += i + 1
+		}
+
+		child, ok := node.children[path[i+1:end]]
+		if !ok {
+			break
+		}
+
+		node = child
+		if node.module != nil {
+			module, mount, rest = node.module, path[:end], path[end:]
+		}
+
+		i = end
+	}
+
+	if len(rest) == 0 {
+		rest = "/"
+	}
+
+	return
+}
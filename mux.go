@@ -1,14 +1,29 @@
 package perfect
 
+import (
+	"io/fs"
+	"net/url"
+)
+
 type Mux interface {
 	Router
-	Handle(method, path string, handler RequestHandler)
-	Get(path string, handler RequestHandler)
-	Post(path string, handler RequestHandler)
-	Put(path string, handler RequestHandler)
-	Delete(path string, handler RequestHandler)
-	Head(path string, handler RequestHandler)
+	Handle(method, path string, handler RequestHandler, name ...string)
+	Get(path string, handler RequestHandler, name ...string)
+	Post(path string, handler RequestHandler, name ...string)
+	Put(path string, handler RequestHandler, name ...string)
+	Delete(path string, handler RequestHandler, name ...string)
+	Patch(path string, handler RequestHandler, name ...string)
+	Head(path string, handler RequestHandler, name ...string)
+	WebSocket(path string, handler WebSocketHandler, name ...string)
+
+	BuildPath(name string, params url.Values) (string, error)
+	Routes() []RouteInfo
+
+	Use(middleware ...Middleware)
+	Group(prefix string, middleware ...Middleware) Mux
 
 	Static(path string)
+	StaticFS(path string, fsys fs.FS)
+	StaticFiles() *StaticFiles
 	StaticPrefix() string
 }
@@ -0,0 +1,82 @@
+package perfect
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//returns the value of the Allow header for a path that handles methods.
+//OPTIONS is always allowed, and HEAD is allowed whenever GET is.
+func allowHeader(methods []string) string {
+	allowed := map[string]bool{"OPTIONS": true}
+
+	for _, method := range methods {
+		allowed[method] = true
+		if method == "GET" {
+			allowed["HEAD"] = true
+		}
+	}
+
+	list := make([]string, 0, len(allowed))
+	for method := range allowed {
+		list = append(list, method)
+	}
+
+	sort.Strings(list)
+
+	return strings.Join(list, ", ")
+}
+
+//returns a handler that responds with 405 Method Not Allowed
+func methodNotAllowedHandler(allow string) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Allow", allow)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//returns a handler that answers OPTIONS requests with the allowed methods
+func optionsHandler(allow string) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("Allow", allow)
+		NoContent(w)
+	}
+}
+
+//a ResponseWriter that keeps the headers but discards the body
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+//returns the original writer, i.e. to flush it
+func (w *headResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//returns a handler that serves HEAD requests using a GET handler
+func headHandler(handler RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		handler(&headResponseWriter{w}, r)
+	}
+}
+
+//decides how to answer a request whose method has no handler for the path,
+//given the methods that do. Returns nil if no method handles the path.
+func missingMethodHandler(method string, allowed []string) RequestHandler {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	allow := allowHeader(allowed)
+
+	if method == "OPTIONS" {
+		return optionsHandler(allow)
+	}
+
+	return methodNotAllowedHandler(allow)
+}
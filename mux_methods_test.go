@@ -0,0 +1,79 @@
+package perfect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMux_Methods(t *testing.T) {
+	muxes := map[string]Mux{
+		"HTTPMux":   NewHTTPMux(),
+		"PrettyMux": NewPrettyMux(),
+	}
+
+	get := func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("X-Handler", "get")
+		w.Write([]byte("GET body"))
+	}
+
+	post := func(w http.ResponseWriter, r *Request) {
+		w.Header().Set("X-Handler", "post")
+	}
+
+	tests := []struct {
+		Method, Path string
+		Code         int
+		Allow        string
+		Handler      string
+		Body         string
+	}{
+		{"GET", "/a", http.StatusOK, "", "get", "GET body"},
+		{"HEAD", "/a", http.StatusOK, "", "get", ""},
+		{"POST", "/a", http.StatusOK, "", "post", ""},
+		{"PUT", "/a", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST", "", ""},
+		{"OPTIONS", "/a", http.StatusNoContent, "GET, HEAD, OPTIONS, POST", "", ""},
+		{"PATCH", "/b", http.StatusOK, "", "post", ""},
+		{"GET", "/b", http.StatusMethodNotAllowed, "OPTIONS, PATCH", "", ""},
+		{"HEAD", "/b", http.StatusMethodNotAllowed, "OPTIONS, PATCH", "", ""},
+		{"OPTIONS", "/b", http.StatusNoContent, "OPTIONS, PATCH", "", ""},
+		{"GET", "/c", http.StatusNotFound, "", "", ""},
+		{"OPTIONS", "/c", http.StatusNotFound, "", "", ""},
+	}
+
+	for name, mux := range muxes {
+		mux.Get("/a", get)
+		mux.Post("/a", post)
+		mux.Patch("/b", post)
+
+		for _, test := range tests {
+			http_request := &http.Request{
+				Method: test.Method,
+				URL:    &url.URL{Path: test.Path},
+				Header: http.Header{},
+			}
+
+			request := NewRequest(http_request, test.Path, &Module{})
+			response := httptest.NewRecorder()
+
+			mux.Route(response, request)
+
+			if response.Code != test.Code {
+				t.Errorf("%v: %v %v response code is %v, expected %v", name, test.Method, test.Path, response.Code, test.Code)
+			}
+
+			if allow := response.Header().Get("Allow"); allow != test.Allow {
+				t.Errorf("%v: %v %v Allow header is '%v', expected '%v'", name, test.Method, test.Path, allow, test.Allow)
+			}
+
+			if handler := response.Header().Get("X-Handler"); handler != test.Handler {
+				t.Errorf("%v: %v %v was handled by '%v', expected '%v'", name, test.Method, test.Path, handler, test.Handler)
+			}
+
+			if test.Code != http.StatusNotFound && test.Code != http.StatusMethodNotAllowed && response.Body.String() != test.Body {
+				t.Errorf("%v: %v %v body is '%v', expected '%v'", name, test.Method, test.Path, response.Body.String(), test.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package perfect
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Describes a panic that was recovered while handling a request
+type PanicReport struct {
+	Time        time.Time   `json:"time"`
+	Module      string      `json:"module"`
+	Error       string      `json:"error"`
+	Stack       string      `json:"stack"`
+	Fingerprint string      `json:"fingerprint"`
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	Header      http.Header `json:"header,omitempty"`
+	Values      url.Values  `json:"values,omitempty"`
+	RemoteAddr  string      `json:"remote_addr"`
+	UserAgent   string      `json:"user_agent,omitempty"`
+
+	//the body of the request, if the handler read it with RawBody. Secret
+	//fields are redacted, and bodies that aren't JSON are masked entirely.
+	Body json.RawMessage `json:"body,omitempty"`
+
+	//the number of identical panics that were not reported since the last
+	//report with the same fingerprint
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+//Sends panic reports somewhere, i.e. to a file, a webhook or an issue tracker.
+//Report is called on its own goroutine, after the client has received a 500
+//Internal Server Error response.
+type PanicReporter interface {
+	Report(report *PanicReport) error
+}
+
+//returns the error message of a recovered value, which can be anything
+//passed to panic()
+func panicMessage(r interface{}) string {
+	switch c := r.(type) {
+	case string:
+		return c
+	case error:
+		return c.Error()
+	case fmt.Stringer:
+		return c.String()
+	default:
+		return fmt.Sprintf("%#v", r)
+	}
+}
+
+//returns the stack of the panicking goroutine, and its fingerprint. The
+//fingerprint only depends on the functions and lines in the stack, so that
+//the same panic always has the same fingerprint, regardless of its message.
+func panicStack(skip int) (stack, fingerprint string) {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	buf := &bytes.Buffer{}
+	hash := sha256.New()
+
+	for {
+		frame, more := frames.Next()
+
+		fmt.Fprintf(buf, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		fmt.Fprintf(hash, "%s:%d\n", frame.Function, frame.Line)
+
+		if !more {
+			break
+		}
+	}
+
+	return buf.String(), hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+//returns a report for a panic recovered while handling r. Secrets are removed
+//from the request with Redact.
+func newPanicReport(r *Request, recovered interface{}, stack, fingerprint string) *PanicReport {
+	report := &PanicReport{
+		Time:        time.Now(),
+		Error:       panicMessage(recovered),
+		Stack:       stack,
+		Fingerprint: fingerprint,
+		Method:      r.Method,
+		URL:         Redact.URL(r.Request.URL),
+		Header:      Redact.Header(r.Header),
+		Values:      Redact.Values(r.Values),
+		RemoteAddr:  r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+		Body:        r.redactedBody(),
+	}
+
+	if r.Module != nil {
+		report.Module = r.Module.Name
+	}
+
+	return report
+}
+
+//sends the report, logging any errors. Reporters must never crash the server,
+//so panics in the reporter are recovered and logged as well.
+func sendPanicReport(reporter PanicReporter, report *PanicReport) {
+	defer func() {
+		if r_err := recover(); r_err != nil {
+			log.Println("Panic reporter failed:", panicMessage(r_err))
+		}
+	}()
+
+	if err := reporter.Report(report); err != nil {
+		log.Println("Failed to report panic", report.Fingerprint, "in", report.Module+":", err)
+	}
+}
+
+//Writes each report as a line of JSON, i.e. to a file or to os.Stderr
+type FileReporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+//returns a reporter that writes JSON lines to w
+func NewFileReporter(w io.Writer) *FileReporter {
+	return &FileReporter{w: w}
+}
+
+//returns a reporter that appends JSON lines to a file, creating it if it
+//doesn't exist
+func OpenFileReporter(path string) (*FileReporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFileReporter(f), nil
+}
+
+func (fr *FileReporter) Report(report *PanicReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+
+	_, err = fr.w.Write(append(data, '\n'))
+
+	return err
+}
+
+//POSTs each report as JSON to a URL
+type WebhookReporter struct {
+	URL    string
+	Header http.Header //additional headers, i.e. for authentication
+	Client *http.Client
+}
+
+//returns a reporter that POSTs reports to url, with a 10 second timeout
+func NewWebhookReporter(url string) *WebhookReporter {
+	return &WebhookReporter{
+		URL:    url,
+		Header: make(http.Header),
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (wr *WebhookReporter) Report(report *PanicReport) error {
+	_, err := postJSON(wr.Client, wr.URL, wr.Header, report)
+	return err
+}
+
+//POSTs data as JSON to url, and returns the body of the response. Responses
+//with a status other than 2xx are returned as errors.
+func postJSON(client *http.Client, url string, header http.Header, data interface{}) ([]byte, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return result, fmt.Errorf("%s responded with %s: %s", url, response.Status, strings.TrimSpace(string(result)))
+	}
+
+	return result, nil
+}
+
+//the last time a panic with a given fingerprint was reported
+type panicSeen struct {
+	reported   time.Time
+	suppressed int
+}
+
+//Deduplicates and rate limits reports before passing them on to another
+//reporter. A panic with the same fingerprint as one that was reported less
+//than Interval ago is not reported; instead, the number of such panics is
+//included in the next report with that fingerprint. At most Limit reports
+//are sent per Interval; the rest are dropped.
+type ThrottledReporter struct {
+	Reporter PanicReporter
+	Interval time.Duration
+	Limit    int
+
+	lock        sync.Mutex
+	seen        map[string]*panicSeen
+	windowStart time.Time
+	count       int
+}
+
+//returns a reporter that sends at most limit reports per interval to reporter,
+//and reports each distinct panic at most once per interval
+func NewThrottledReporter(reporter PanicReporter, interval time.Duration, limit int) *ThrottledReporter {
+	return &ThrottledReporter{
+		Reporter: reporter,
+		Interval: interval,
+		Limit:    limit,
+		seen:     make(map[string]*panicSeen),
+	}
+}
+
+//decides whether the report should be sent, and updates its Suppressed count
+func (tr *ThrottledReporter) allow(report *PanicReport) bool {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	now := report.Time
+
+	if tr.seen == nil {
+		tr.seen = make(map[string]*panicSeen)
+	}
+
+	//forget panics that haven't happened in a while, so that the map
+	//doesn't grow forever
+	if now.Sub(tr.windowStart) >= tr.Interval {
+		for fingerprint, seen := range tr.seen {
+			if now.Sub(seen.reported) >= tr.Interval && seen.suppressed == 0 {
+				delete(tr.seen, fingerprint)
+			}
+		}
+		tr.windowStart = now
+		tr.count = 0
+	}
+
+	seen, ok := tr.seen[report.Fingerprint]
+	if ok && now.Sub(seen.reported) < tr.Interval {
+		seen.suppressed++
+		return false
+	}
+
+	if tr.Limit > 0 && tr.count >= tr.Limit {
+		if ok {
+			seen.suppressed++
+		}
+		return false
+	}
+
+	tr.count++
+
+	if !ok {
+		seen = &panicSeen{}
+		tr.seen[report.Fingerprint] = seen
+	}
+
+	report.Suppressed = seen.suppressed
+	seen.reported = now
+	seen.suppressed = 0
+
+	return true
+}
+
+func (tr *ThrottledReporter) Report(report *PanicReport) error {
+	if !tr.allow(report) {
+		return nil
+	}
+
+	return tr.Reporter.Report(report)
+}
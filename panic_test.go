@@ -0,0 +1,266 @@
+package perfect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//a reporter that sends reports to a channel
+type chanReporter chan *PanicReport
+
+func (c chanReporter) Report(report *PanicReport) error {
+	c <- report
+	return nil
+}
+
+//a reporter that always fails
+type failingReporter struct {
+	panics bool
+}
+
+func (f failingReporter) Report(report *PanicReport) error {
+	if f.panics {
+		panic("reporter panic")
+	}
+
+	return errors.New("reporter error")
+}
+
+func TestModuleMux_Panic(t *testing.T) {
+	mux := NewModuleMux()
+	reports := make(chanReporter, 10)
+	mux.SetPanicReporter(reports)
+
+	module := &Module{Name: "panics", Mux: NewHTTPMux()}
+	module.Get("/string", func(w http.ResponseWriter, r *Request) {
+		panic("string panic")
+	})
+	module.Get("/error", func(w http.ResponseWriter, r *Request) {
+		panic(errors.New("error panic"))
+	})
+	module.Get("/other", func(w http.ResponseWriter, r *Request) {
+		panic(42)
+	})
+	mux.Mount(module, "/")
+
+	tests := []struct {
+		Path, Error string
+	}{
+		{"/string", "string panic"},
+		{"/error", "error panic"},
+		{"/other", "42"},
+		{"/string?again=1", "string panic"},
+	}
+
+	fingerprints := make(map[string]string)
+
+	for _, test := range tests {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://localhost"+test.Path, nil)
+
+		mux.ServeHTTP(response, request)
+
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf("%v: status = %v, expected %v", test.Path, response.Code, http.StatusInternalServerError)
+		}
+
+		if response.Body.String() != "Internal Server Error\n" {
+			t.Errorf("%v: body = %q", test.Path, response.Body.String())
+		}
+
+		var report *PanicReport
+		select {
+		case report = <-reports:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: no report", test.Path)
+		}
+
+		if report.Error != test.Error || report.Module != "panics" || report.Method != "GET" {
+			t.Errorf("%v: report = %#v", test.Path, report)
+		}
+
+		if !strings.Contains(report.Stack, "TestModuleMux_Panic") {
+			t.Errorf("%v: stack does not include the handler:\n%v", test.Path, report.Stack)
+		}
+
+		//identical panics have the same fingerprint
+		if other, ok := fingerprints[test.Error]; ok && other != report.Fingerprint {
+			t.Errorf("%v: fingerprint = %v, expected %v", test.Path, report.Fingerprint, other)
+		}
+		fingerprints[test.Error] = report.Fingerprint
+	}
+
+	if fingerprints["string panic"] == fingerprints["error panic"] {
+		t.Errorf("different panics have the same fingerprint")
+	}
+
+	//failing reporters must not affect the response
+	for _, reporter := range []PanicReporter{failingReporter{}, failingReporter{panics: true}} {
+		mux.SetPanicReporter(reporter)
+
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://localhost/string", nil)
+		mux.ServeHTTP(response, request)
+
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf("status = %v, expected %v", response.Code, http.StatusInternalServerError)
+		}
+
+		sendPanicReport(reporter, &PanicReport{})
+	}
+}
+
+func TestThrottledReporter(t *testing.T) {
+	reports := make(chanReporter, 10)
+	throttled := NewThrottledReporter(reports, time.Minute, 2)
+
+	start := time.Now()
+
+	tests := []struct {
+		Fingerprint string
+		After       time.Duration
+		Reported    bool
+		Suppressed  int
+	}{
+		{"a", 0, true, 0},
+		{"a", time.Second, false, 0},
+		{"a", 2 * time.Second, false, 0},
+		{"b", 3 * time.Second, true, 0},
+		//over the limit
+		{"c", 4 * time.Second, false, 0},
+		//new window
+		{"a", 61 * time.Second, true, 2},
+		{"c", 62 * time.Second, true, 0},
+		{"b", 63 * time.Second, false, 0},
+	}
+
+	for i, test := range tests {
+		err := throttled.Report(&PanicReport{Fingerprint: test.Fingerprint, Time: start.Add(test.After)})
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+
+		select {
+		case report := <-reports:
+			if !test.Reported {
+				t.Errorf("%v: %v was reported", i, test.Fingerprint)
+			} else if report.Suppressed != test.Suppressed {
+				t.Errorf("%v: suppressed = %v, expected %v", i, report.Suppressed, test.Suppressed)
+			}
+		default:
+			if test.Reported {
+				t.Errorf("%v: %v was not reported", i, test.Fingerprint)
+			}
+		}
+	}
+}
+
+func TestFileReporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	reporter := NewFileReporter(buf)
+
+	for _, e := range []string{"first", "second"} {
+		if err := reporter.Report(&PanicReport{Error: e}); err != nil {
+			t.Fatalf("err = %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%v lines, expected 2: %v", len(lines), buf.String())
+	}
+
+	report := &PanicReport{}
+	if err := json.Unmarshal([]byte(lines[1]), report); err != nil || report.Error != "second" {
+		t.Errorf("report = %#v, err = %v", report, err)
+	}
+}
+
+func TestWebhookReporter(t *testing.T) {
+	var body []byte
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret") != "s3cret" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	reporter := NewWebhookReporter(server.URL)
+	reporter.Header.Set("X-Secret", "s3cret")
+
+	if err := reporter.Report(&PanicReport{Error: "boom"}); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	report := &PanicReport{}
+	if err := json.Unmarshal(body, report); err != nil || report.Error != "boom" {
+		t.Errorf("report = %#v, err = %v", report, err)
+	}
+
+	status = http.StatusBadGateway
+	if err := reporter.Report(&PanicReport{Error: "boom"}); err == nil {
+		t.Errorf("expected an error for status %v", status)
+	}
+}
+
+func TestGithubReporter(t *testing.T) {
+	issue := &GithubIssue{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/owner/repo/issues" {
+			t.Errorf("path = %v", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "token t0ken" {
+			t.Errorf("Authorization = %v", r.Header.Get("Authorization"))
+		}
+		json.NewDecoder(r.Body).Decode(issue)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 1, "html_url": "https://github.com/owner/repo/issues/1"}`))
+	}))
+	defer server.Close()
+
+	reporter := NewGithubReporter("owner/repo", "t0ken", "bug")
+	reporter.URL = strings.Replace(reporter.URL, GITHUB_API_URL, server.URL, 1)
+
+	err := reporter.Report(&PanicReport{Module: "forms", Error: "boom", Stack: "main.main"})
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if !strings.Contains(issue.Title, "forms") || !strings.Contains(issue.Body, "main.main") {
+		t.Errorf("issue = %#v", issue)
+	}
+
+	if strings.Join(issue.Labels, ",") != "auto,panic,bug,forms" {
+		t.Errorf("labels = %v", issue.Labels)
+	}
+
+	//only the start of the first line of the error goes into the title
+	long := strings.Repeat("x", GITHUB_TITLE_LENGTH+10)
+	issue = &GithubIssue{}
+
+	err = reporter.Report(&PanicReport{Error: long + "\npassword=s3cret", Stack: "main.main"})
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	title := "Automatic Panic Report: " + long[:GITHUB_TITLE_LENGTH] + "..."
+	if issue.Title != title {
+		t.Errorf("title = %q, expected %q", issue.Title, title)
+	}
+
+	if strings.Join(issue.Labels, ",") != "auto,panic,bug" {
+		t.Errorf("labels = %v", issue.Labels)
+	}
+}
@@ -1,106 +1,150 @@
 package perfect
 
 import (
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
-type prettyRoute struct {
-	path     string
-	elements []string
-	handler  RequestHandler
-}
-
-func (r *prettyRoute) Match(path_elements []string) (bool, *url.Values) {
-	//quick check to see if the number of elements are the same
-	if len(r.elements) != len(path_elements) {
-		return false, nil
-	}
-
-	values := &url.Values{}
-
-	for i, e := range r.elements {
-		//check named parameters
-		if strings.HasPrefix(e, ":") {
-			parts := strings.SplitN(e, ":", 2)
-			//only store the value of the named parameter if it exists.
-			//this also means that /:/ is valid syntax and does not result
-			//in a named parameter
-			if len(parts) > 1 && len(parts[1]) > 0 {
-				values.Add(parts[1], path_elements[i])
-			}
-			continue
-		}
-
-		if e != path_elements[i] {
-			return false, nil
-		}
-	}
-
-	return true, values
-}
-
 type PrettyMux struct {
 	staticPrefix   string
 	hasStaticFiles bool
+	static         *StaticFiles
+
+	//radix tree of all routes, for all HTTP methods
+	tree *routeNode
 
-	//map [HTTP_METHOD] list of pretty routes
-	routes map[string][]prettyRoute
+	//all methods that have at least one route
+	methods []string
+
+	//map [route name] parsed path expression
+	names map[string][]routeSegment
+
+	middleware []Middleware
+	routes     []RouteInfo
+	groups     routeGroups
 }
 
 func NewPrettyMux() *PrettyMux {
 	return &PrettyMux{
-		routes: make(map[string][]prettyRoute),
+		tree:  &routeNode{},
+		names: make(map[string][]routeSegment),
 	}
 }
 
-//generic method that registers a handler for a path and http method
-func (pm *PrettyMux) Handle(method string, expr string, handler RequestHandler) {
+//generic method that registers a handler for a path and http method, with
+//an optional route name that can be used to build URLs with BuildPath.
+//Panics if the path expression is invalid, since such a route would
+//otherwise silently never match, if the method already has a route for the
+//same path (parameter names aside), or if the name is already in use.
+func (pm *PrettyMux) Handle(method string, expr string, handler RequestHandler, name ...string) {
+	pm.handle(method, expr, handler, handler, name)
+}
 
-	_, ok := pm.routes[method]
+//registers handler, and records origin as the handler defined by the user
+func (pm *PrettyMux) handle(method, expr string, handler RequestHandler, origin interface{}, name []string) {
 
-	if !ok {
-		pm.routes[method] = make([]prettyRoute, 0)
+	expr = strings.TrimSuffix(expr, "/")
+
+	routes, err := newPrettyRoutes(expr, handler)
+	if err != nil {
+		panic(err)
 	}
 
-	expr = strings.TrimSuffix(expr, "/")
+	if err := pm.tree.add(method, routes...); err != nil {
+		panic(err)
+	}
 
-	route := prettyRoute{
-		path:     expr,
-		elements: strings.Split(expr, "/"),
-		handler:  handler,
+	if !pm.hasMethod(method) {
+		pm.methods = append(pm.methods, method)
 	}
 
-	pm.routes[method] = append(pm.routes[method], route)
+	//routes[0] is always the complete expression
+	for _, n := range name {
+		if _, ok := pm.names[n]; ok {
+			panic(fmt.Errorf("%s '%s'", ErrDuplicateRoute, n))
+		}
+		pm.names[n] = routes[0].segments
+	}
+
+	pm.routes = append(pm.routes, newRouteInfo(method, expr, origin, name))
 
 	log.Println("[pretty mux]", method, expr, handler)
 }
 
+//returns all registered routes
+func (pm *PrettyMux) Routes() []RouteInfo {
+	return copyRouteInfo(pm.routes)
+}
+
 //registers a GET request handler
-func (pm *PrettyMux) Get(expr string, handler RequestHandler) {
-	pm.Handle("GET", expr, handler)
+func (pm *PrettyMux) Get(expr string, handler RequestHandler, name ...string) {
+	pm.Handle("GET", expr, handler, name...)
 }
 
 //registers a POST request handler
-func (pm *PrettyMux) Post(path string, handler RequestHandler) {
-	pm.Handle("POST", path, handler)
+func (pm *PrettyMux) Post(path string, handler RequestHandler, name ...string) {
+	pm.Handle("POST", path, handler, name...)
 }
 
 //registers a PUT request handler
-func (pm *PrettyMux) Put(path string, handler RequestHandler) {
-	pm.Handle("PUT", path, handler)
+func (pm *PrettyMux) Put(path string, handler RequestHandler, name ...string) {
+	pm.Handle("PUT", path, handler, name...)
 }
 
 //registers a DELETE request handler
-func (pm *PrettyMux) Delete(path string, handler RequestHandler) {
-	pm.Handle("DELETE", path, handler)
+func (pm *PrettyMux) Delete(path string, handler RequestHandler, name ...string) {
+	pm.Handle("DELETE", path, handler, name...)
+}
+
+//registers a PATCH request handler
+func (pm *PrettyMux) Patch(path string, handler RequestHandler, name ...string) {
+	pm.Handle("PATCH", path, handler, name...)
+}
+
+//registers a WebSocket endpoint. Requests that don't upgrade the connection
+//are refused with 400 Bad Request.
+func (pm *PrettyMux) WebSocket(expr string, handler WebSocketHandler, name ...string) {
+	pm.handle("GET", expr, webSocketHandler(handler), handler, name)
 }
 
 //registers a HEAD request handler
-func (pm *PrettyMux) Head(path string, handler RequestHandler) {
-	pm.Handle("HEAD", path, handler)
+func (pm *PrettyMux) Head(path string, handler RequestHandler, name ...string) {
+	pm.Handle("HEAD", path, handler, name...)
+}
+
+//builds the path of a named route, relative to the module. Named parameters
+//are taken from params, and removed from it as they are used.
+func (pm *PrettyMux) BuildPath(name string, params url.Values) (string, error) {
+	segments, ok := pm.names[name]
+	if !ok {
+		return "", fmt.Errorf("%s '%s'", ErrNoSuchRoute, name)
+	}
+
+	path, err := buildRoutePath(segments, params)
+	if err != nil {
+		return "", fmt.Errorf("route '%s': %s", name, err)
+	}
+
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	return path, nil
+}
+
+//checks whether any route has been registered for the method
+func (pm *PrettyMux) hasMethod(method string) bool {
+	for _, m := range pm.methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
 }
 
 //returns a static/dynamic request handler for the given request
@@ -112,31 +156,48 @@ func (pm *PrettyMux) FindHandler(r *Request) RequestHandler {
 		return pm.StaticHandler
 	}
 
-	//GET, POST, PUT
-	routes, ok := pm.routes[r.Request.Method]
+	var segments [8]string
 
-	if !ok {
-		return nil
-	}
+	method := r.Request.Method
+	path := strings.TrimSuffix(r.URL.Path, "/")
 
-	path_elements := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	route, matched := pm.tree.find(method, path, segments[:0])
 
-	for _, route := range routes {
-		matches, values := route.Match(path_elements)
-		if matches {
-			//prepend all values to request
-			//prepending mimics the order of these values in the URL, in case
-			//of repeating parameters (i.e. /:id/:id -> /1/2?id=3) -> {"id": [1,2,3]}
+	//HEAD requests are served by GET handlers, without the body
+	head := false
+	if route == nil && method == "HEAD" {
+		route, matched = pm.tree.find("GET", path, segments[:0])
+		head = route != nil
+	}
 
-			for p, v := range *values {
-				r.Values[p] = append(v, r.Values[p]...)
+	//405 Method Not Allowed or OPTIONS, if other methods handle this path
+	if route == nil {
+		allowed := make([]string, 0)
+		for _, m := range pm.methods {
+			if other, _ := pm.tree.find(m, path, segments[:0]); other != nil {
+				allowed = append(allowed, m)
 			}
+		}
 
-			return route.handler
+		if handler := missingMethodHandler(method, allowed); handler != nil {
+			return pm.groups.wrap(path, true, handler)
 		}
+
+		return nil
 	}
 
-	return nil
+	//prepend all values to request
+	//prepending mimics the order of these values in the URL, in case
+	//of repeating parameters (i.e. /:id/:id -> /1/2?id=3) -> {"id": [1,2,3]}
+	for p, v := range route.Values(matched) {
+		r.Values[p] = append(v, r.Values[p]...)
+	}
+
+	if head {
+		return headHandler(route.handler)
+	}
+
+	return route.handler
 }
 
 //checks whether a request is for a static resource
@@ -146,34 +207,69 @@ func (pm *PrettyMux) isStatic(r *Request) bool {
 
 //a request handler for static resources
 func (pm *PrettyMux) StaticHandler(w http.ResponseWriter, r *Request) {
-	http.ServeFile(w, r.Request, r.Module.Path+r.URL.Path)
+	pm.StaticFiles().Serve(w, r, pm.staticPrefix, strings.TrimPrefix(r.URL.Path, pm.staticPrefix))
 }
 
-// finds and invokes the Handlers for the given request
+//returns the server for static files, to configure caching
+func (pm *PrettyMux) StaticFiles() *StaticFiles {
+	if pm.static == nil {
+		pm.static = NewStaticFiles(nil)
+	}
+
+	return pm.static
+}
+
+// finds and invokes the Handlers for the given request. Middleware added
+// with Use runs for every request, whether it is for a static resource, a
+// route, or a path that could not be found.
 func (pm *PrettyMux) Route(w http.ResponseWriter, r *Request) {
 	handler := pm.FindHandler(r)
 
 	if handler == nil {
-		http.NotFound(w, r.Request)
-		return
+		handler = pm.groups.wrap(r.URL.Path, true, notFoundHandler)
+	} else {
+		//TODO: remove these 2 lines when optimizing performance
+		name, file, line := HandlerInfo(handler)
+		log.Printf("%s %s%s -> %s at %s:%d\n", r.Method, r.Module.MountPoint, Redact.URL(r.URL), name, file, line)
 	}
 
-	//TODO: remove these 2 lines when optimizing performance
-	name, file, line := HandlerInfo(handler)
-	log.Printf("%s %s%s -> %s at %s:%d\n", r.Method, r.Module.MountPoint, r.URL, name, file, line)
-
 	//invoke the handler
-	handler(w, r)
+	chain(pm.middleware, handler)(w, r)
 }
 
-//sets the static path
+//adds middleware that runs for every request handled by this mux
+func (pm *PrettyMux) Use(middleware ...Middleware) {
+	pm.middleware = append(pm.middleware, middleware...)
+}
+
+//returns a sub-router for routes that share a path prefix and middleware.
+//Requests for paths under the prefix that have no route, or no route for
+//their method, go through the middleware as well. Groups with an empty or
+//"/" prefix only wrap their own routes.
+func (pm *PrettyMux) Group(prefix string, middleware ...Middleware) Mux {
+	return newRouteGroup(pm, prefix, middleware)
+}
+
+//keeps track of a group, to apply its middleware to missing routes
+func (pm *PrettyMux) addGroup(g *routeGroup) {
+	pm.groups = append(pm.groups, g)
+}
+
+//sets the static path. Files are served from the module's directory.
 func (pm *PrettyMux) Static(path string) {
+	pm.StaticFS(path, nil)
+}
+
+//sets the static path, and the file system that static files are served
+//from, i.e. an embed.FS
+func (pm *PrettyMux) StaticFS(path string, fsys fs.FS) {
 	if path[len(path)-1:] != "/" {
 		path += "/"
 	}
 
 	pm.staticPrefix = path
 	pm.hasStaticFiles = true
+	pm.static = NewStaticFiles(fsys)
 }
 
 func (pm *PrettyMux) StaticPrefix() string {
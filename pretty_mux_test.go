@@ -1,9 +1,11 @@
 package perfect
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -48,9 +50,13 @@ func TestPrettyMux_FindHandler(t *testing.T) {
 		called = true
 	}
 
-	//register all the routes first
+	//register all the routes first; some are tested with several paths
+	registered := map[string]bool{}
 	for _, test_case := range routeTests {
-		m.Get(test_case.RoutePath, expected_handler)
+		if !registered[test_case.RoutePath] {
+			m.Get(test_case.RoutePath, expected_handler)
+			registered[test_case.RoutePath] = true
+		}
 	}
 
 	for i, test_case := range routeTests {
@@ -86,3 +92,289 @@ func TestPrettyMux_FindHandler(t *testing.T) {
 		}
 	}
 }
+
+func newPrettyTestRequest(t *testing.T, method, path string) *Request {
+	request_url, err := url.Parse("http://localhost" + path)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	http_request := &http.Request{
+		Method: method,
+		URL:    request_url,
+		Header: http.Header{},
+	}
+
+	return NewRequest(http_request, request_url.Path, &Module{})
+}
+
+func TestPrettyMux_StaticPriority(t *testing.T) {
+	var matched string
+
+	m := NewPrettyMux()
+
+	//register the dynamic route first, it must not shadow the static one
+	m.Get("/users/:id", func(w http.ResponseWriter, r *Request) {
+		matched = "param"
+	})
+	m.Get("/users/new", func(w http.ResponseWriter, r *Request) {
+		matched = "static"
+	})
+	m.Get("/users/new/:step", func(w http.ResponseWriter, r *Request) {
+		matched = "static+param"
+	})
+	m.Get("/users/:id/edit", func(w http.ResponseWriter, r *Request) {
+		matched = "param+static"
+	})
+
+	tests := map[string]string{
+		"/users/new":        "static",
+		"/users/new/":       "static",
+		"/users/newer":      "param",
+		"/users/123":        "param",
+		"/users/new/2":      "static+param",
+		"/users/new/edit":   "static+param",
+		"/users/123/edit":   "param+static",
+		"/users/123/delete": "",
+		"/users":            "",
+		"/users//edit":      "",
+	}
+
+	for path, expected := range tests {
+		matched = ""
+		request := newPrettyTestRequest(t, "GET", path)
+
+		handler := m.FindHandler(request)
+		if handler != nil {
+			handler(httptest.NewRecorder(), request)
+		}
+
+		if matched != expected {
+			t.Errorf("%v matched '%v', expected '%v'", path, matched, expected)
+		}
+	}
+}
+
+func TestPrettyMux_Values(t *testing.T) {
+	m := NewPrettyMux()
+	handler := func(w http.ResponseWriter, r *Request) {}
+
+	m.Get("/id/:id/:id/:id", handler)
+	m.Get("/:study/:/:form", handler)
+	m.Post("/:name", handler)
+
+	request := newPrettyTestRequest(t, "GET", "/id/1/2/3?id=4")
+	if m.FindHandler(request) == nil {
+		t.Fatalf("handler is nil, expected non-nil")
+	}
+
+	if ids := request.Values["id"]; !reflect.DeepEqual(ids, []string{"1", "2", "3", "4"}) {
+		t.Errorf("id values are %v, expected [1 2 3 4]", ids)
+	}
+
+	request = newPrettyTestRequest(t, "GET", "/A/skipped/B")
+	if m.FindHandler(request) == nil {
+		t.Fatalf("handler is nil, expected non-nil")
+	}
+
+	expected := url.Values{"study": {"A"}, "form": {"B"}}
+	if !reflect.DeepEqual(request.Values, expected) {
+		t.Errorf("values are %v, expected %v", request.Values, expected)
+	}
+
+	//the method must match as well
+	request = newPrettyTestRequest(t, "GET", "/A")
+	response := httptest.NewRecorder()
+	m.FindHandler(request)(response, request)
+
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /A response code is %v, expected %v", response.Code, http.StatusMethodNotAllowed)
+	}
+
+	if len(request.Values) != 0 {
+		t.Errorf("GET /A values are %v, expected none", request.Values)
+	}
+}
+
+func BenchmarkPrettyMux_FindHandler(b *testing.B) {
+	m := NewPrettyMux()
+	handler := func(w http.ResponseWriter, r *Request) {}
+
+	for _, test_case := range routeTests {
+		m.Get(test_case.RoutePath, handler)
+	}
+
+	http_request := &http.Request{Method: "GET", Header: http.Header{}}
+	request := &Request{
+		Request: http_request,
+		URL:     &url.URL{Path: "/study/abcd/form/foo/subjects/abcd123/info"},
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		request.Values = url.Values{}
+		m.FindHandler(request)
+	}
+}
+
+func TestPrettyMux_Patterns(t *testing.T) {
+	var matched string
+
+	m := NewPrettyMux()
+
+	route := func(name string) RequestHandler {
+		return func(w http.ResponseWriter, r *Request) {
+			matched = name
+		}
+	}
+
+	m.Get("/users/:name", route("name"))
+	m.Get("/users/:id{[0-9]+}", route("id"))
+	m.Get("/users/new", route("new"))
+	m.Get("/posts/:slug{[a-z-]+}", route("slug"))
+	m.Get("/files/*path", route("files"))
+	m.Get("/archive/:year{[0-9]{4}}?/:month?", route("archive"))
+	m.Get("/assets/*path?", route("assets"))
+
+	tests := []struct {
+		Path, Route string
+		Values      url.Values
+	}{
+		{"/users/new", "new", url.Values{}},
+		{"/users/42", "id", url.Values{"id": {"42"}}},
+		{"/users/bob", "name", url.Values{"name": {"bob"}}},
+		{"/posts/hello-world", "slug", url.Values{"slug": {"hello-world"}}},
+		{"/posts/Hello", "", url.Values{}},
+		{"/files/a/b/c.txt", "files", url.Values{"path": {"a/b/c.txt"}}},
+		{"/files", "", url.Values{}},
+		{"/archive", "archive", url.Values{}},
+		{"/archive/2014", "archive", url.Values{"year": {"2014"}}},
+		{"/archive/2014/10", "archive", url.Values{"year": {"2014"}, "month": {"10"}}},
+		{"/archive/14", "", url.Values{}},
+		{"/archive/2014/10/1", "", url.Values{}},
+		{"/assets", "assets", url.Values{}},
+		{"/assets/css/app.css", "assets", url.Values{"path": {"css/app.css"}}},
+	}
+
+	for _, test := range tests {
+		matched = ""
+		request := newPrettyTestRequest(t, "GET", test.Path)
+
+		handler := m.FindHandler(request)
+		if handler != nil {
+			handler(httptest.NewRecorder(), request)
+		}
+
+		if matched != test.Route {
+			t.Errorf("%v matched '%v', expected '%v'", test.Path, matched, test.Route)
+		}
+
+		if !reflect.DeepEqual(request.Values, test.Values) {
+			t.Errorf("%v values are %v, expected %v", test.Path, request.Values, test.Values)
+		}
+	}
+}
+
+func TestPrettyMux_InvalidPatterns(t *testing.T) {
+	patterns := []string{
+		"/files/*path/info",
+		"/users/:id{[0-9]+",
+		"/users/:id{[0-9}",
+		"/archive/:year?/:month",
+		"/files/*path{.+}",
+	}
+
+	for _, pattern := range patterns {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Handle(%v) did not panic, expected an invalid route error", pattern)
+				}
+			}()
+
+			NewPrettyMux().Get(pattern, func(w http.ResponseWriter, r *Request) {})
+		}()
+	}
+}
+
+func TestPrettyMux_DuplicateRoutes(t *testing.T) {
+	tests := []struct {
+		First, Second, Path string
+	}{
+		{"/a/:id", "/a/:id", "/a/5"},
+		{"/a/:id", "/a/:name", "/a/5"},
+		{"/a/:id{[0-9]+}", "/a/:name{[0-9]+}", "/a/5"},
+		{"/files/*path", "/files/*name", "/files/x"},
+		{"/archive", "/archive/:year?", "/archive"},
+		{"/users", "/users/", "/users"},
+	}
+
+	for _, test := range tests {
+		m := NewPrettyMux()
+		matched := ""
+		m.Get(test.First, func(w http.ResponseWriter, r *Request) { matched = "first" })
+
+		func() {
+			defer func() {
+				err, _ := recover().(error)
+				if !errors.Is(err, ErrDuplicateRoute) {
+					t.Errorf("%v, %v: err = %v, expected %v", test.First, test.Second, err, ErrDuplicateRoute)
+				}
+			}()
+
+			m.Get(test.Second, func(w http.ResponseWriter, r *Request) { matched = "second" })
+		}()
+
+		//the first route is still served
+		request := newPrettyTestRequest(t, "GET", test.Path)
+		if handler := m.FindHandler(request); handler != nil {
+			handler(httptest.NewRecorder(), request)
+		}
+
+		if matched != "first" {
+			t.Errorf("%v, %v: matched %q, expected the first route", test.First, test.Second, matched)
+		}
+	}
+
+	//other methods, and routes with different constraints, are not duplicates
+	m := NewPrettyMux()
+	m.Get("/a/:id{[0-9]+}", func(w http.ResponseWriter, r *Request) {})
+	m.Get("/a/:name", func(w http.ResponseWriter, r *Request) {})
+	m.Post("/a/:name", func(w http.ResponseWriter, r *Request) {})
+
+	//registrations that fail don't add nodes to the tree
+	m.Get("/archive", func(w http.ResponseWriter, r *Request) {})
+	nodes := countRouteNodes(m.tree)
+
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrDuplicateRoute) {
+				t.Errorf("err = %v, expected %v", err, ErrDuplicateRoute)
+			}
+		}()
+		m.Get("/archive/:year{[0-9]{4}}?", func(w http.ResponseWriter, r *Request) {})
+	}()
+
+	if count := countRouteNodes(m.tree); count != nodes {
+		t.Errorf("the tree has %v nodes, expected %v", count, nodes)
+	}
+}
+
+//returns the number of nodes in the tree
+func countRouteNodes(n *routeNode) int {
+	count := 1
+
+	for _, child := range n.children {
+		count += countRouteNodes(child)
+	}
+
+	for _, child := range n.params {
+		count += countRouteNodes(child)
+	}
+
+	if n.catchAll != nil {
+		count += countRouteNodes(n.catchAll)
+	}
+
+	return count
+}
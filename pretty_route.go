@@ -0,0 +1,230 @@
+package perfect
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+//kinds of route segments
+const (
+	segmentStatic = iota
+	segmentParam
+	segmentCatchAll
+)
+
+//a single element of a route expression. Supported syntax:
+//	static      matches 'static' exactly
+//	:name       matches any one segment
+//	:name{re}   matches one segment, if the whole segment matches 're'
+//	*name       matches the rest of the path, and must be the last segment
+//	:name?      optional; only trailing segments can be optional
+type routeSegment struct {
+	kind       int
+	value      string //the static text, or the name of the parameter
+	constraint string
+	re         *regexp.Regexp
+	optional   bool
+}
+
+//parses one '/'-delimited element of a route expression
+func parseRouteSegment(e string) (s routeSegment, err error) {
+	if !strings.HasPrefix(e, ":") && !strings.HasPrefix(e, "*") {
+		s.kind = segmentStatic
+		s.value = e
+		return
+	}
+
+	if e[0] == '*' {
+		s.kind = segmentCatchAll
+	} else {
+		s.kind = segmentParam
+	}
+
+	name := e[1:]
+
+	if strings.HasSuffix(name, "?") {
+		s.optional = true
+		name = name[:len(name)-1]
+	}
+
+	if i := strings.Index(name, "{"); i >= 0 {
+		if !strings.HasSuffix(name, "}") {
+			err = fmt.Errorf("unterminated constraint in '%s'", e)
+			return
+		}
+
+		if s.kind == segmentCatchAll {
+			err = fmt.Errorf("catch-all segment '%s' cannot have a constraint", e)
+			return
+		}
+
+		s.constraint = name[i+1 : len(name)-1]
+		name = name[:i]
+
+		//constraints must match the whole segment
+		s.re, err = regexp.Compile("^(?:" + s.constraint + ")$")
+		if err != nil {
+			err = fmt.Errorf("invalid constraint in '%s': %s", e, err)
+			return
+		}
+	}
+
+	if strings.ContainsAny(name, "{}?") {
+		err = fmt.Errorf("invalid parameter name in '%s'", e)
+		return
+	}
+
+	s.value = name
+
+	return
+}
+
+//parses a route expression into its segments
+func parseRoute(expr string) (segments []routeSegment, err error) {
+	optional := false
+
+	elements := strings.Split(expr, "/")
+
+	for i, e := range elements {
+		s, err := parseRouteSegment(e)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.kind == segmentCatchAll && i != len(elements)-1 {
+			return nil, fmt.Errorf("catch-all segment '%s' must be the last segment", e)
+		}
+
+		if optional && !s.optional {
+			return nil, fmt.Errorf("segment '%s' follows an optional segment and must be optional", e)
+		}
+
+		optional = s.optional
+
+		segments = append(segments, s)
+	}
+
+	return
+}
+
+type prettyRoute struct {
+	path     string
+	segments []routeSegment
+	params   []string //names of the named parameters, in URL order
+	handler  RequestHandler
+}
+
+//returns all routes described by the path expression. Expressions that
+//contain optional segments result in one route for each optional segment,
+//i.e. /archive/:year?/:month? -> /archive, /archive/:year, /archive/:year/:month
+func newPrettyRoutes(expr string, handler RequestHandler) (routes []*prettyRoute, err error) {
+	segments, err := parseRoute(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s '%s': %s", ErrInvalidRoute, expr, err)
+	}
+
+	for n := len(segments); n > 0; n-- {
+		routes = append(routes, newPrettyRoute(segments[:n], handler))
+
+		if !segments[n-1].optional {
+			break
+		}
+	}
+
+	return
+}
+
+//returns a new route for the parsed path expression
+func newPrettyRoute(segments []routeSegment, handler RequestHandler) *prettyRoute {
+	route := &prettyRoute{
+		segments: segments,
+		handler:  handler,
+	}
+
+	elements := make([]string, len(segments))
+
+	for i, s := range segments {
+		switch s.kind {
+		case segmentStatic:
+			elements[i] = s.value
+		case segmentParam:
+			elements[i] = ":" + s.value
+			if len(s.constraint) > 0 {
+				elements[i] += "{" + s.constraint + "}"
+			}
+			route.params = append(route.params, s.value)
+		case segmentCatchAll:
+			elements[i] = "*" + s.value
+			route.params = append(route.params, s.value)
+		}
+	}
+
+	route.path = strings.Join(elements, "/")
+
+	return route
+}
+
+//maps the values of the matched path segments to their parameter names
+func (r *prettyRoute) Values(segments []string) url.Values {
+	values := make(url.Values, len(r.params))
+
+	for i, name := range r.params {
+		//only store the value of the named parameter if it exists.
+		//this also means that /:/ is valid syntax and does not result
+		//in a named parameter
+		if len(name) > 0 {
+			values.Add(name, segments[i])
+		}
+	}
+
+	return values
+}
+
+//builds the path described by the segments of a route expression, using the
+//values of its named parameters. Values are removed from params as they
+//are used, so that only the unused ones remain.
+func buildRoutePath(segments []routeSegment, params url.Values) (string, error) {
+	elements := make([]string, 0, len(segments))
+
+	for _, s := range segments {
+		if s.kind == segmentStatic {
+			elements = append(elements, s.value)
+			continue
+		}
+
+		values := params[s.value]
+		if len(values) == 0 {
+			//optional segments are always trailing
+			if s.optional {
+				break
+			}
+			return "", fmt.Errorf("%s '%s'", ErrMissingParameter, s.value)
+		}
+
+		value := values[0]
+		if len(values) > 1 {
+			params[s.value] = values[1:]
+		} else {
+			delete(params, s.value)
+		}
+
+		if s.re != nil && !s.re.MatchString(value) {
+			return "", fmt.Errorf("%s '%s': '%s' does not match '%s'", ErrInvalidParameter, s.value, value, s.constraint)
+		}
+
+		//catch-all values can span multiple segments
+		if s.kind == segmentCatchAll {
+			parts := strings.Split(value, "/")
+			for i, part := range parts {
+				parts[i] = url.PathEscape(part)
+			}
+			elements = append(elements, strings.Join(parts, "/"))
+		} else {
+			elements = append(elements, url.PathEscape(value))
+		}
+	}
+
+	return strings.Join(elements, "/"), nil
+}
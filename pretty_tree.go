@@ -0,0 +1,290 @@
+package perfect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//a node in the compressed radix tree used by PrettyMux. Static nodes match
+//their prefix byte by byte, param nodes match exactly one path segment and
+//catch-all nodes match the rest of the path. Parameter names are not stored
+//in the tree, but in the routes attached to each node. This way, routes
+//such as /:study and /:id/:name can share a node.
+type routeNode struct {
+	prefix   string
+	indices  string //the first byte of each static child
+	children []*routeNode
+	params   []*routeNode //constrained params first, unconstrained last
+	catchAll *routeNode
+
+	//param nodes only
+	constraint string
+	re         *regexp.Regexp
+
+	//map [HTTP_METHOD] route
+	routes map[string]*prettyRoute
+}
+
+//returns the number of bytes a and b have in common, from the start
+func commonPrefix(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+//walks (and extends) the static children of n so that the returned node is
+//reached after consuming s
+func (n *routeNode) addStatic(s string) *routeNode {
+	if len(s) == 0 {
+		return n
+	}
+
+	for i := 0; i < len(n.indices); i++ {
+		if n.indices[i] != s[0] {
+			continue
+		}
+
+		child := n.children[i]
+		l := commonPrefix(child.prefix, s)
+
+		//split the child if s only shares part of its prefix
+		if l < len(child.prefix) {
+			split := &routeNode{
+				prefix:   child.prefix[:l],
+				indices:  child.prefix[l : l+1],
+				children: []*routeNode{child},
+			}
+			child.prefix = child.prefix[l:]
+			n.children[i] = split
+			child = split
+		}
+
+		return child.addStatic(s[l:])
+	}
+
+	child := &routeNode{prefix: s}
+	n.indices += s[:1]
+	n.children = append(n.children, child)
+
+	return child
+}
+
+//returns the param child of n for the segment's constraint, creating it if
+//necessary. Constrained params are kept in registration order, ahead of the
+//unconstrained param, so that they are tried first.
+func (n *routeNode) addParam(s routeSegment) *routeNode {
+	for _, child := range n.params {
+		if child.constraint == s.constraint {
+			return child
+		}
+	}
+
+	child := &routeNode{constraint: s.constraint, re: s.re}
+
+	i := len(n.params)
+	if i > 0 && n.params[i-1].re == nil && child.re != nil {
+		i--
+	}
+
+	n.params = append(n.params, nil)
+	copy(n.params[i+1:], n.params[i:])
+	n.params[i] = child
+
+	return child
+}
+
+//returns the catch-all child of n, creating it if necessary
+func (n *routeNode) addCatchAll() *routeNode {
+	if n.catchAll == nil {
+		n.catchAll = &routeNode{}
+	}
+
+	return n.catchAll
+}
+
+//returns the node that routes with the segments of route are attached to,
+//extending the tree if needed
+func (n *routeNode) node(route *prettyRoute) *routeNode {
+	node := n
+	static := ""
+
+	for i, s := range route.segments {
+		if i > 0 {
+			static += "/"
+		}
+
+		switch s.kind {
+		case segmentStatic:
+			static += s.value
+			continue
+		case segmentParam:
+			node = node.addStatic(static).addParam(s)
+		case segmentCatchAll:
+			node = node.addStatic(static).addCatchAll()
+		}
+
+		static = ""
+	}
+
+	return node.addStatic(static)
+}
+
+//returns the static descendant of n that is reached after consuming s, or
+//nil if the tree doesn't have one
+func (n *routeNode) findStatic(s string) *routeNode {
+	if len(s) == 0 {
+		return n
+	}
+
+	for i := 0; i < len(n.indices); i++ {
+		if n.indices[i] != s[0] {
+			continue
+		}
+
+		child := n.children[i]
+		if !strings.HasPrefix(s, child.prefix) {
+			return nil
+		}
+
+		return child.findStatic(s[len(child.prefix):])
+	}
+
+	return nil
+}
+
+//returns the param child of n for the segment's constraint, or nil
+func (n *routeNode) findParam(s routeSegment) *routeNode {
+	for _, child := range n.params {
+		if child.constraint == s.constraint {
+			return child
+		}
+	}
+
+	return nil
+}
+
+//returns the node that routes with the segments of route are attached to,
+//or nil if the tree doesn't have it. Unlike node, it never changes the tree.
+func (n *routeNode) lookup(route *prettyRoute) *routeNode {
+	node := n
+	static := ""
+
+	for i, s := range route.segments {
+		if i > 0 {
+			static += "/"
+		}
+
+		if s.kind == segmentStatic {
+			static += s.value
+			continue
+		}
+
+		if node = node.findStatic(static); node == nil {
+			return nil
+		}
+
+		switch s.kind {
+		case segmentParam:
+			node = node.findParam(s)
+		case segmentCatchAll:
+			node = node.catchAll
+		}
+
+		if node == nil {
+			return nil
+		}
+
+		static = ""
+	}
+
+	return node.findStatic(static)
+}
+
+//Adds routes to the tree, under the given method. Routes that differ only by
+//the names of their parameters share a node, so they are duplicates too.
+//Returns ErrDuplicateRoute if a node already has a route for the method,
+//without changing the tree.
+func (n *routeNode) add(method string, routes ...*prettyRoute) error {
+	for _, route := range routes {
+		if node := n.lookup(route); node != nil {
+			if existing, ok := node.routes[method]; ok {
+				return fmt.Errorf("%w: %s %s conflicts with %s", ErrDuplicateRoute, method, route.path, existing.path)
+			}
+		}
+	}
+
+	for _, route := range routes {
+		node := n.node(route)
+		if node.routes == nil {
+			node.routes = make(map[string]*prettyRoute)
+		}
+
+		node.routes[method] = route
+	}
+
+	return nil
+}
+
+//finds the route that matches path for the given method. Static children
+//take priority over constrained params, which take priority over the
+//unconstrained param and finally the catch-all. If a branch does not lead to
+//a route, the search backtracks and tries the next one.
+//The values of all matched segments are appended to values, in URL order.
+func (n *routeNode) find(method, path string, values []string) (*prettyRoute, []string) {
+	if len(path) == 0 {
+		if route, ok := n.routes[method]; ok {
+			return route, values
+		}
+		return nil, values
+	}
+
+	//static children first
+	if i := strings.IndexByte(n.indices, path[0]); i >= 0 {
+		child := n.children[i]
+		if strings.HasPrefix(path, child.prefix) {
+			route, v := child.find(method, path[len(child.prefix):], values)
+			if route != nil {
+				return route, v
+			}
+		}
+	}
+
+	//then the param children, which match one non-empty path segment
+	if len(n.params) > 0 {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+
+		segment := path[:end]
+
+		for _, child := range n.params {
+			if end == 0 || (child.re != nil && !child.re.MatchString(segment)) {
+				continue
+			}
+
+			route, v := child.find(method, path[end:], append(values, segment))
+			if route != nil {
+				return route, v
+			}
+		}
+	}
+
+	//the catch-all matches everything else
+	if n.catchAll != nil {
+		if route, ok := n.catchAll.routes[method]; ok {
+			return route, append(values, path)
+		}
+	}
+
+	return nil, values
+}
@@ -0,0 +1,416 @@
+package perfect
+
+import (
+	"fmt"
+	"github.com/vpetrov/perfect/orm"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//rate limiting algorithms
+const (
+	//allows bursts of up to Limit requests, and refills Limit tokens
+	//every Period
+	TOKEN_BUCKET = iota
+	//allows Limit requests in any Period, estimated from the number of
+	//requests in the current and the previous window
+	SLIDING_WINDOW
+)
+
+const (
+	//how often the memory store removes expired counters
+	RATE_LIMIT_SWEEP = time.Minute
+)
+
+//Returns the key that requests are counted by, i.e. the client IP
+type RateLimitKey func(r *Request) (string, error)
+
+//counts requests by client IP. Behind a reverse proxy, the proxy must be
+//trusted with ModuleMux.TrustProxies, or all clients share one counter.
+func KeyByIP(r *Request) (string, error) {
+	return "ip:" + r.ClientIP(), nil
+}
+
+//counts requests by session, or by client IP for clients that don't have
+//a session yet. Unknown session ids are counted by IP too, so that clients
+//can't avoid the limit by sending a new cookie with every request.
+func KeyBySession(r *Request) (string, error) {
+	session_id, ok := r.Cookie(SESSION_ID)
+	if !ok {
+		return KeyByIP(r)
+	}
+
+	session, err := r.Session()
+	if err != nil {
+		return "", err
+	}
+
+	if *session.Id != session_id {
+		return KeyByIP(r)
+	}
+
+	return "session:" + session_id, nil
+}
+
+//counts requests by the profile of the user, or by session for users that
+//haven't logged in
+func KeyByProfile(r *Request) (string, error) {
+	if _, ok := r.Cookie(SESSION_ID); !ok {
+		return KeyByIP(r)
+	}
+
+	profile, err := r.Profile()
+	if err != nil {
+		return "", err
+	}
+
+	if profile == nil || profile.Id == nil {
+		return KeyBySession(r)
+	}
+
+	return "profile:" + *profile.Id, nil
+}
+
+//The counter of a key
+type RateLimitState struct {
+	orm.Object `bson:",inline,omitempty" json:"-"`
+	Key        *string    `bson:"key,omitempty" json:"key"`
+	Count      *float64   `bson:"count,omitempty" json:"count"`       //tokens left, or requests in the current window
+	Previous   *float64   `bson:"previous,omitempty" json:"previous"` //requests in the previous window
+	Start      *time.Time `bson:"start,omitempty" json:"start"`       //the last refill, or the start of the current window
+	Expires    *time.Time `bson:"expires,omitempty" json:"expires"`   //when the counter can be removed
+}
+
+//Keeps the counters of a RateLimiter. The limiter doesn't let two requests
+//update the same key at the same time, but requests for different keys use
+//the store concurrently, and stores that are shared by several processes
+//can still lose updates.
+type RateLimitStore interface {
+	//returns the counter of key, or nil if it doesn't exist
+	Get(key string) (*RateLimitState, error)
+	Set(state *RateLimitState) error
+}
+
+//A RateLimitStore that keeps counters in memory
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	states    map[string]RateLimitState
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		states:    make(map[string]RateLimitState),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryRateLimitStore) Get(key string) (*RateLimitState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+func (s *MemoryRateLimitStore) Set(state *RateLimitState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.states[*state.Key] = *state
+
+	//remove expired counters, so that the store doesn't keep growing
+	now := time.Now()
+	if now.Sub(s.lastSweep) > RATE_LIMIT_SWEEP {
+		for key, state := range s.states {
+			if state.Expires != nil && state.Expires.Before(now) {
+				delete(s.states, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	return nil
+}
+
+//A RateLimitStore that keeps counters in a database collection, so that
+//several processes can share them. Expired counters are not removed.
+type CollectionRateLimitStore struct {
+	Collection orm.Collection
+}
+
+func NewCollectionRateLimitStore(collection orm.Collection) *CollectionRateLimitStore {
+	return &CollectionRateLimitStore{
+		Collection: collection,
+	}
+}
+
+func (s *CollectionRateLimitStore) Get(key string) (*RateLimitState, error) {
+	state := &RateLimitState{Key: orm.String(key)}
+
+	err := s.Collection.Find(state)
+	if err == orm.ErrNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *CollectionRateLimitStore) Set(state *RateLimitState) error {
+	return s.Collection.Save(state)
+}
+
+//The outcome of counting a request
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration //until the limit is fully available again
+	RetryAfter time.Duration //until the next request is allowed
+}
+
+//Limits how many requests a client can make in a period of time. Requests
+//over the limit receive 429 Too Many Requests, with a Retry-After header.
+//All responses have RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+//headers.
+//Limiters can be used for a whole module, a group or a single route:
+//	limiter := perfect.NewRateLimiter(perfect.TOKEN_BUCKET, 5, time.Minute, perfect.KeyByIP)
+//	module.Post("/login", limiter.Middleware(handler))
+type RateLimiter struct {
+	Algorithm int
+	Limit     int
+	Period    time.Duration
+	Key       RateLimitKey
+	Store     RateLimitStore
+
+	//separates the counters of limiters that share a store
+	Prefix string
+
+	//the locks of the keys that are being updated
+	lock sync.Mutex
+	keys map[string]*rateLimitKeyLock
+	now  func() time.Time
+}
+
+//the lock of one key, and the number of requests that hold or wait for it
+type rateLimitKeyLock struct {
+	sync.Mutex
+	waiting int
+}
+
+//returns a limiter that keeps its counters in memory. Panics if the
+//algorithm, the limit or the period is invalid.
+func NewRateLimiter(algorithm, limit int, period time.Duration, key RateLimitKey) *RateLimiter {
+	if algorithm != TOKEN_BUCKET && algorithm != SLIDING_WINDOW {
+		panic(fmt.Errorf("invalid rate limiting algorithm %d", algorithm))
+	}
+
+	if limit <= 0 || period <= 0 {
+		panic(fmt.Errorf("invalid rate limit %d per %v", limit, period))
+	}
+
+	return &RateLimiter{
+		Algorithm: algorithm,
+		Limit:     limit,
+		Period:    period,
+		Key:       key,
+		Store:     NewMemoryRateLimitStore(),
+		now:       time.Now,
+	}
+}
+
+//Returns middleware that limits requests, i.e.
+//	api := module.Group("/api", perfect.RateLimit(perfect.SLIDING_WINDOW, 100, time.Minute, perfect.KeyByProfile))
+func RateLimit(algorithm, limit int, period time.Duration, key RateLimitKey) Middleware {
+	return NewRateLimiter(algorithm, limit, period, key).Middleware
+}
+
+//wraps handler, so that clients over the limit are rejected
+func (l *RateLimiter) Middleware(handler RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		key, err := l.Key(r)
+		if err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		result, err := l.Take(key)
+		if err != nil {
+			Error(w, r, err)
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", seconds(result.Reset))
+
+		if !result.Allowed {
+			header.Set("Retry-After", seconds(result.RetryAfter))
+			Error(w, r, ErrTooManyRequests)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+//returns a duration in whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+//Counts a request for key, and returns whether it's allowed
+func (l *RateLimiter) Take(key string) (*RateLimitResult, error) {
+	key = l.Prefix + key
+
+	defer l.lockKey(key)()
+
+	state, err := l.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if state == nil {
+		state = &RateLimitState{Key: orm.String(key)}
+	}
+
+	now := l.now()
+
+	var result *RateLimitResult
+	if l.Algorithm == SLIDING_WINDOW {
+		result = l.slidingWindow(state, now)
+	} else {
+		result = l.tokenBucket(state, now)
+	}
+
+	state.Expires = orm.Time(now.Add(result.Reset))
+
+	if err := l.Store.Set(state); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//locks key until the returned function is called. Locks are removed when
+//no request needs them anymore, so only keys in use take up memory.
+func (l *RateLimiter) lockKey(key string) func() {
+	l.lock.Lock()
+	if l.keys == nil {
+		l.keys = make(map[string]*rateLimitKeyLock)
+	}
+
+	key_lock, ok := l.keys[key]
+	if !ok {
+		key_lock = &rateLimitKeyLock{}
+		l.keys[key] = key_lock
+	}
+	key_lock.waiting++
+	l.lock.Unlock()
+
+	key_lock.Lock()
+
+	return func() {
+		key_lock.Unlock()
+
+		l.lock.Lock()
+		key_lock.waiting--
+		if key_lock.waiting == 0 {
+			delete(l.keys, key)
+		}
+		l.lock.Unlock()
+	}
+}
+
+func (l *RateLimiter) tokenBucket(state *RateLimitState, now time.Time) *RateLimitResult {
+	limit := float64(l.Limit)
+	//tokens per second
+	rate := limit / l.Period.Seconds()
+
+	tokens := limit
+	if state.Count != nil && state.Start != nil {
+		tokens = math.Min(limit, *state.Count+now.Sub(*state.Start).Seconds()*rate)
+	}
+
+	result := &RateLimitResult{Limit: l.Limit}
+
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+
+	state.Count = orm.Float64(tokens)
+	state.Start = orm.Time(now)
+
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((limit - tokens) / rate * float64(time.Second))
+
+	return result
+}
+
+func (l *RateLimiter) slidingWindow(state *RateLimitState, now time.Time) *RateLimitResult {
+	start := now.Truncate(l.Period)
+	count, previous := 0.0, 0.0
+
+	if state.Start != nil && state.Count != nil {
+		switch start.Sub(*state.Start) {
+		case 0:
+			count = *state.Count
+			if state.Previous != nil {
+				previous = *state.Previous
+			}
+		case l.Period:
+			previous = *state.Count
+		}
+	}
+
+	//the requests of the previous window count less as the current one goes on
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(l.Period)
+	estimate := previous*weight + count
+
+	limit := float64(l.Limit)
+	result := &RateLimitResult{
+		Limit: l.Limit,
+		Reset: l.Period - elapsed,
+	}
+
+	if estimate+1 <= limit {
+		count++
+		estimate++
+		result.Allowed = true
+	} else if count+1 <= limit {
+		//wait until enough of the previous window has slid out
+		result.RetryAfter = time.Duration((1-(limit-count-1)/previous)*float64(l.Period)) - elapsed
+	} else {
+		//wait for the next window, and until enough of this one has slid out
+		result.RetryAfter = l.Period - elapsed + time.Duration((1-(limit-1)/count)*float64(l.Period))
+	}
+
+	//the requests of this window still count during the next one
+	if count > 0 {
+		result.Reset += l.Period
+	}
+
+	result.Remaining = int(math.Max(0, math.Floor(limit-estimate)))
+
+	state.Count = orm.Float64(count)
+	state.Previous = orm.Float64(previous)
+	state.Start = orm.Time(start)
+
+	return result
+}
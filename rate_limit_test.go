@@ -0,0 +1,336 @@
+package perfect
+
+import (
+	"github.com/vpetrov/perfect/orm"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//a clock that only moves when told to
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+//returns a limiter with a clock that starts at the beginning of a period
+func newTestRateLimiter(algorithm, limit int, period time.Duration) (*RateLimiter, *testClock) {
+	clock := &testClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	limiter := NewRateLimiter(algorithm, limit, period, KeyByIP)
+	limiter.now = clock.Now
+
+	return limiter, clock
+}
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	limiter, clock := newTestRateLimiter(TOKEN_BUCKET, 3, 3*time.Second)
+
+	type step struct {
+		Wait       time.Duration
+		Allowed    bool
+		Remaining  int
+		RetryAfter time.Duration
+	}
+
+	steps := []step{
+		//bursts of up to 3 requests
+		{0, true, 2, 0},
+		{0, true, 1, 0},
+		{0, true, 0, 0},
+		{0, false, 0, time.Second},
+		//one token per second
+		{500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{500 * time.Millisecond, true, 0, 0},
+		{10 * time.Second, true, 2, 0},
+	}
+
+	for i, s := range steps {
+		clock.Add(s.Wait)
+
+		result, err := limiter.Take("client")
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+
+		if result.Allowed != s.Allowed || result.Remaining != s.Remaining || result.RetryAfter != s.RetryAfter {
+			t.Errorf("step %v: result = %+v, expected %+v", i, result, s)
+		}
+	}
+
+	//other keys have their own counters
+	if result, _ := limiter.Take("other"); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestRateLimiter_SlidingWindow(t *testing.T) {
+	limiter, clock := newTestRateLimiter(SLIDING_WINDOW, 4, time.Minute)
+
+	type step struct {
+		Wait       time.Duration
+		Allowed    bool
+		Remaining  int
+		RetryAfter time.Duration
+	}
+
+	steps := []step{
+		{0, true, 3, 0},
+		{0, true, 2, 0},
+		{30 * time.Second, true, 1, 0},
+		{0, true, 0, 0},
+		//wait for the next window, and until 3 of the 4 requests count
+		{0, false, 0, 30*time.Second + 15*time.Second},
+		//a quarter of the next window: the previous requests count as 3
+		{45 * time.Second, true, 0, 0},
+		{0, false, 0, 15 * time.Second},
+		{15 * time.Second, true, 0, 0},
+		//the requests of the previous window no longer count
+		{2 * time.Minute, true, 3, 0},
+	}
+
+	for i, s := range steps {
+		clock.Add(s.Wait)
+
+		result, err := limiter.Take("client")
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+
+		if result.Allowed != s.Allowed || result.Remaining != s.Remaining || result.RetryAfter != s.RetryAfter {
+			t.Errorf("step %v: result = %+v, expected %+v", i, result, s)
+		}
+	}
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	limiter, clock := newTestRateLimiter(TOKEN_BUCKET, 2, time.Minute)
+
+	module := &Module{Name: "limits", Mux: NewPrettyMux()}
+	module.Post("/login", limiter.Middleware(func(w http.ResponseWriter, r *Request) {
+		w.Write([]byte("ok"))
+	}))
+	module.Post("/open", func(w http.ResponseWriter, r *Request) {})
+
+	post := func(path, addr string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "http://localhost"+path, nil)
+		request.RemoteAddr = addr
+
+		response := httptest.NewRecorder()
+		module.Route(response, NewRequest(request, path, module))
+		return response
+	}
+
+	tests := []struct {
+		Path, Addr                     string
+		Status                         int
+		Limit, Remaining, Reset, Retry string
+	}{
+		{"/login", "10.0.0.1:1000", http.StatusOK, "2", "1", "30", ""},
+		{"/login", "10.0.0.1:1001", http.StatusOK, "2", "0", "60", ""},
+		{"/login", "10.0.0.1:1002", http.StatusTooManyRequests, "2", "0", "60", "30"},
+		{"/login", "10.0.0.2:1000", http.StatusOK, "2", "1", "30", ""},
+		{"/open", "10.0.0.1:1003", http.StatusOK, "", "", "", ""},
+	}
+
+	for _, test := range tests {
+		response := post(test.Path, test.Addr)
+		header := response.Header()
+
+		if response.Code != test.Status {
+			t.Errorf("%v %v: status = %v, expected %v", test.Path, test.Addr, response.Code, test.Status)
+		}
+
+		if header.Get("RateLimit-Limit") != test.Limit || header.Get("RateLimit-Remaining") != test.Remaining ||
+			header.Get("RateLimit-Reset") != test.Reset || header.Get("Retry-After") != test.Retry {
+			t.Errorf("%v %v: header = %v", test.Path, test.Addr, header)
+		}
+	}
+
+	clock.Add(30 * time.Second)
+	if response := post("/login", "10.0.0.1:1004"); response.Code != http.StatusOK {
+		t.Errorf("status = %v, expected %v", response.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimiter_Keys(t *testing.T) {
+	db := newSessionDatabase()
+	module := &Module{Name: "limits", Db: db}
+
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	r := NewRequest(request, "/", module)
+
+	session, _ := r.Session()
+
+	tests := []struct {
+		Name    string
+		Key     RateLimitKey
+		Cookie  string
+		Profile *string
+		Result  string
+	}{
+		{"ip", KeyByIP, "", nil, "ip:10.0.0.1"},
+		{"no session", KeyBySession, "", nil, "ip:10.0.0.1"},
+		{"unknown session", KeyBySession, "forged", nil, "ip:10.0.0.1"},
+		{"session", KeyBySession, *session.Id, nil, "session:" + *session.Id},
+		{"no profile", KeyByProfile, *session.Id, nil, "session:" + *session.Id},
+		{"profile", KeyByProfile, *session.Id, orm.String("bob@example.com"), "profile:bob@example.com"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "http://localhost/", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		if len(test.Cookie) > 0 {
+			request.AddCookie(&http.Cookie{Name: SESSION_ID, Value: test.Cookie})
+		}
+
+		r := NewRequest(request, "/", module)
+		if test.Profile != nil {
+			r.profile = &Profile{Id: test.Profile}
+		}
+
+		key, err := test.Key(r)
+		if err != nil || key != test.Result {
+			t.Errorf("%v: key = %v, err = %v, expected %v", test.Name, key, err, test.Result)
+		}
+	}
+}
+
+//a store that blocks reads of one key until it is released
+type blockingRateLimitStore struct {
+	*MemoryRateLimitStore
+	key      string
+	reading  chan bool
+	released chan bool
+}
+
+func (s *blockingRateLimitStore) Get(key string) (*RateLimitState, error) {
+	if key == s.key {
+		s.reading <- true
+		<-s.released
+	}
+
+	return s.MemoryRateLimitStore.Get(key)
+}
+
+func TestRateLimiter_KeyLocks(t *testing.T) {
+	limiter, _ := newTestRateLimiter(TOKEN_BUCKET, 50, time.Minute)
+	store := &blockingRateLimitStore{
+		MemoryRateLimitStore: NewMemoryRateLimitStore(),
+		key:                  "ip:10.0.0.1",
+		reading:              make(chan bool),
+		released:             make(chan bool),
+	}
+	limiter.Store = store
+
+	slow := make(chan error)
+	go func() {
+		_, err := limiter.Take("ip:10.0.0.1")
+		slow <- err
+	}()
+	<-store.reading
+
+	//other keys don't wait for the slow one
+	fast := make(chan error)
+	go func() {
+		_, err := limiter.Take("ip:10.0.0.2")
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Take(ip:10.0.0.2) waited for another key")
+	}
+
+	close(store.released)
+	if err := <-slow; err != nil {
+		t.Errorf("err = %v", err)
+	}
+
+	//requests for the same key don't lose updates
+	store.key = ""
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.Take("ip:10.0.0.3")
+		}()
+	}
+	wg.Wait()
+
+	if result, _ := limiter.Take("ip:10.0.0.3"); result.Allowed {
+		t.Errorf("result = %+v, expected the limit to be reached", result)
+	}
+
+	if len(limiter.keys) != 0 {
+		t.Errorf("keys = %v, expected none", limiter.keys)
+	}
+}
+
+//a collection that keeps one record per key
+type rateLimitCollection struct {
+	orm.Collection
+	states map[string]RateLimitState
+}
+
+func (c *rateLimitCollection) Find(r orm.Record) error {
+	state := r.(*RateLimitState)
+
+	saved, ok := c.states[*state.Key]
+	if !ok {
+		return orm.ErrNotFound
+	}
+
+	*state = saved
+	return nil
+}
+
+func (c *rateLimitCollection) Save(r orm.Record) error {
+	state := r.(*RateLimitState)
+	if state.Id == nil {
+		state.Id = *state.Key
+	}
+
+	c.states[*state.Key] = *state
+	return nil
+}
+
+func TestCollectionRateLimitStore(t *testing.T) {
+	collection := &rateLimitCollection{states: map[string]RateLimitState{}}
+
+	//two processes that share a collection
+	first, _ := newTestRateLimiter(SLIDING_WINDOW, 2, time.Minute)
+	second, _ := newTestRateLimiter(SLIDING_WINDOW, 2, time.Minute)
+	first.Store = NewCollectionRateLimitStore(collection)
+	second.Store = NewCollectionRateLimitStore(collection)
+
+	for i, limiter := range []*RateLimiter{first, second, first} {
+		result, err := limiter.Take("ip:10.0.0.1")
+		if err != nil {
+			t.Fatalf("err = %v", err)
+		}
+
+		if result.Allowed != (i < 2) {
+			t.Errorf("request %v: result = %+v", i, result)
+		}
+	}
+
+	if len(collection.states) != 1 {
+		t.Errorf("states = %v", collection.states)
+	}
+}
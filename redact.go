@@ -0,0 +1,246 @@
+package perfect
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	//replaces the values of secrets in logs and reports
+	REDACTED = "[REDACTED]"
+)
+
+//Removes secrets from requests before they are logged or reported. Names
+//are case-insensitive. JSON fields are redacted at any depth.
+//Redactors must be configured before the server starts.
+type Redactor struct {
+	Headers []string
+	Cookies []string
+	Query   []string
+	Fields  []string
+
+	//the value that replaces secrets, REDACTED by default
+	Mask string
+}
+
+//returns a redactor that removes credentials, session ids, passwords and
+//tokens
+func NewRedactor() *Redactor {
+	return &Redactor{
+		Headers: []string{"Authorization", "Proxy-Authorization", "X-Api-Key"},
+		Cookies: []string{SESSION_ID},
+		Query:   []string{"password", "access_token", "token", "secret", "api_key"},
+		Fields:  []string{"password", "access_token", "token", "secret", "api_key"},
+		Mask:    REDACTED,
+	}
+}
+
+//the redactor used by all logs and reports of this package
+var Redact = NewRedactor()
+
+//checks whether name is in list, ignoring case
+func redactedName(list []string, name string) bool {
+	for _, n := range list {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rd *Redactor) mask() string {
+	if len(rd.Mask) == 0 {
+		return REDACTED
+	}
+
+	return rd.Mask
+}
+
+//returns a copy of header, with the values of secret headers and cookies
+//replaced by the mask
+func (rd *Redactor) Header(header http.Header) http.Header {
+	result := make(http.Header, len(header))
+
+	for key, values := range header {
+		masked := make([]string, len(values))
+
+		for i, value := range values {
+			switch {
+			case redactedName(rd.Headers, key):
+				masked[i] = rd.mask()
+			case strings.EqualFold(key, "Cookie"):
+				masked[i] = rd.cookies(value)
+			case strings.EqualFold(key, "Set-Cookie"):
+				masked[i] = rd.setCookie(value)
+			default:
+				masked[i] = value
+			}
+		}
+
+		result[key] = masked
+	}
+
+	return result
+}
+
+//masks secret cookies in the value of a Cookie header
+func (rd *Redactor) cookies(value string) string {
+	pairs := strings.Split(value, ";")
+
+	for i, pair := range pairs {
+		name := strings.TrimSpace(strings.SplitN(pair, "=", 2)[0])
+		if redactedName(rd.Cookies, name) {
+			pairs[i] = " " + name + "=" + rd.mask()
+			if i == 0 {
+				pairs[i] = pairs[i][1:]
+			}
+		}
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+//masks a secret cookie in the value of a Set-Cookie header
+func (rd *Redactor) setCookie(value string) string {
+	parts := strings.SplitN(value, ";", 2)
+	name := strings.TrimSpace(strings.SplitN(parts[0], "=", 2)[0])
+
+	if !redactedName(rd.Cookies, name) {
+		return value
+	}
+
+	parts[0] = name + "=" + rd.mask()
+
+	return strings.Join(parts, ";")
+}
+
+//returns a copy of values, with the values of secret parameters replaced by
+//the mask
+func (rd *Redactor) Values(values url.Values) url.Values {
+	result := make(url.Values, len(values))
+
+	for key, v := range values {
+		if !redactedName(rd.Query, key) && !redactedName(rd.Fields, key) {
+			result[key] = append([]string(nil), v...)
+			continue
+		}
+
+		masked := make([]string, len(v))
+		for i := range masked {
+			masked[i] = rd.mask()
+		}
+		result[key] = masked
+	}
+
+	return result
+}
+
+//returns u as a string, with secret query parameters and the password of
+//the user info masked
+func (rd *Redactor) URL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	redacted := *u
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			redacted.User = url.UserPassword(u.User.Username(), rd.mask())
+		}
+	}
+
+	if len(u.RawQuery) > 0 {
+		values, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			redacted.RawQuery = rd.mask()
+		} else {
+			redacted.RawQuery = rd.Values(values).Encode()
+		}
+	}
+
+	return redacted.String()
+}
+
+//returns a copy of a JSON document, with the values of secret fields replaced
+//by the mask. Documents that aren't valid JSON are masked entirely, since
+//there is no way to tell which parts of them are secret.
+func (rd *Redactor) JSON(data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return []byte(`"` + rd.mask() + `"`)
+	}
+
+	result, err := json.Marshal(rd.value(v))
+	if err != nil {
+		return []byte(`"` + rd.mask() + `"`)
+	}
+
+	return result
+}
+
+//masks secret fields of a decoded JSON value
+func (rd *Redactor) value(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for key, value := range c {
+			if redactedName(rd.Fields, key) {
+				c[key] = rd.mask()
+			} else {
+				c[key] = rd.value(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range c {
+			c[i] = rd.value(value)
+		}
+	}
+
+	return v
+}
+
+//a description of a request that is safe to log
+type redactedRequest struct {
+	Method     string          `json:"method"`
+	URL        string          `json:"url"`
+	Header     http.Header     `json:"header,omitempty"`
+	Values     url.Values      `json:"values,omitempty"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Module     string          `json:"module,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+//encodes the request as JSON, without any of its secrets
+func (r *Request) MarshalJSON() ([]byte, error) {
+	redacted := &redactedRequest{
+		Method:     r.Method,
+		URL:        Redact.URL(r.Request.URL),
+		Header:     Redact.Header(r.Header),
+		Values:     Redact.Values(r.Values),
+		RemoteAddr: r.RemoteAddr,
+		Body:       r.redactedBody(),
+	}
+
+	if r.Module != nil {
+		redacted.Module = r.Module.Name
+	}
+
+	return json.Marshal(redacted)
+}
+
+//returns the body that was read with RawBody, with secret fields masked, or
+//nil if the body wasn't kept
+func (r *Request) redactedBody() json.RawMessage {
+	if len(r.rawBody) == 0 {
+		return nil
+	}
+
+	return Redact.JSON(r.rawBody)
+}
@@ -5,9 +5,9 @@ import (
 	"github.com/vpetrov/perfect/orm"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 //An interface for any type that can route Survana requests
@@ -31,6 +31,11 @@ type Request struct {
 	session *Session
 	profile *Profile
 	Values  url.Values
+	body    *limitedBody
+	rawBody []byte
+
+	//the client address, resolved through trusted proxies
+	clientIP string
 }
 
 // returns a new Request object
@@ -59,6 +64,8 @@ func NewRequest(r *http.Request, path string, module *Module) *Request {
 		req.Values = make(map[string][]string, 0)
 	}
 
+	req.limitBody()
+
 	return req
 }
 
@@ -108,6 +115,34 @@ func (r *Request) SetSession(s *Session) {
 	r.session = s
 }
 
+//checks whether the request has a session, without creating one
+func (r *Request) hasSession() bool {
+	_, ok := r.Cookie(SESSION_ID)
+	return ok || r.session != nil
+}
+
+//sends the session cookie if the client doesn't have it yet, i.e. after the
+//session was created
+func (r *Request) sendSessionCookie(w http.ResponseWriter) {
+	if r.session == nil {
+		return
+	}
+
+	if session_id, _ := r.Cookie(SESSION_ID); session_id == *r.session.Id {
+		return
+	}
+
+	//the response may have the cookie already
+	prefix := SESSION_ID + "=" + *r.session.Id + ";"
+	for _, cookie := range w.Header()["Set-Cookie"] {
+		if strings.HasPrefix(cookie, prefix) {
+			return
+		}
+	}
+
+	r.session.SetCookie(w, r)
+}
+
 //returns nil, nil if the profile was not found
 func (r *Request) Profile() (*Profile, error) {
 	var err error
@@ -143,6 +178,17 @@ func (r *Request) Profile() (*Profile, error) {
 	return r.profile, nil
 }
 
+// returns the address of the client, without the port. Behind proxies
+// trusted with ModuleMux.TrustProxies, this is the address that the
+// proxies forwarded the request for.
+func (r *Request) ClientIP() string {
+	if len(r.clientIP) > 0 {
+		return r.clientIP
+	}
+
+	return remoteIP(r.Request)
+}
+
 // returns the value of the cookie by name
 func (r *Request) Cookie(name string) (value string, ok bool) {
 	ok = false
@@ -156,11 +202,19 @@ func (r *Request) Cookie(name string) (value string, ok bool) {
 	return
 }
 
-// Parses the request body as a JSON-encoded string
+// Parses the request body as a JSON-encoded string, and returns
+// ErrTrailingData if there is anything after the first JSON value.
 func (r *Request) ParseJSON(v interface{}) (err error) {
 	return r.JSONBody(r.Request.Body, v)
 }
 
+// Parses the first JSON value of the request body, and ignores anything that
+// follows it. The body is decoded as it is read, so the rest of it is never
+// read.
+func (r *Request) ParseLooseJSON(v interface{}) (err error) {
+	return decodeJSON(r.Request.Body, v, false)
+}
+
 func (r *Request) StringBody(body io.ReadCloser) (result string, err error) {
 	bytes, err := r.BodyBytes(body)
 	return string(bytes), err
@@ -181,23 +235,53 @@ func (r *Request) BodyBytes(body io.ReadCloser) (result []byte, err error) {
 	return
 }
 
+//decodes body like ParseJSON
 func (r *Request) JSONBody(body io.ReadCloser, v interface{}) (err error) {
+	return decodeJSON(body, v, true)
+}
+
+//decodes a JSON value from body. Returns ErrEmptyRequest if body is empty,
+//and a 400 HTTPError if it isn't valid JSON.
+func decodeJSON(body io.Reader, v interface{}, strict bool) error {
+	if body == nil {
+		return ErrEmptyRequest
+	}
+
+	decoder := json.NewDecoder(body)
+
+	err := decoder.Decode(v)
+	if err == io.EOF {
+		return ErrEmptyRequest
+	}
 
-	// read the body
-	data, err := ioutil.ReadAll(body)
 	if err != nil {
-		return
+		return jsonError(err)
 	}
 
-	if len(data) == 0 {
-		err = ErrEmptyRequest
-		return
+	if strict {
+		var trailing json.RawMessage
+		if err := decoder.Decode(&trailing); err != io.EOF {
+			if err == ErrBodyTooLarge {
+				return err
+			}
+			return ErrTrailingData
+		}
 	}
 
-	log.Println("API data:", string(data))
+	return nil
+}
 
-	//parse the JSON body
-	err = json.Unmarshal(data, v)
+//describes errors in the JSON as invalid JSON, and returns errors that
+//happened while reading the body as they are
+func jsonError(err error) error {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return NewHTTPError(http.StatusBadRequest, "Invalid JSON", err)
+	}
 
-	return
+	if err == io.ErrUnexpectedEOF {
+		return NewHTTPError(http.StatusBadRequest, "Invalid JSON", err)
+	}
+
+	return err
 }
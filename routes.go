@@ -0,0 +1,210 @@
+package perfect
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//Describes a registered route
+type RouteInfo struct {
+	Method     string `json:"method"`
+	Pattern    string `json:"pattern"`
+	Name       string `json:"name,omitempty"`
+	MountPoint string `json:"mount_point,omitempty"`
+	Handler    string `json:"handler"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+}
+
+//Any type that can list its routes, i.e. a Mux or a ModuleMux
+type RouteLister interface {
+	Routes() []RouteInfo
+}
+
+//implemented by muxes that can register a handler that wraps another one.
+//This lets route groups wrap handlers with middleware, while the mux still
+//records where the original handler was defined.
+type routeRegistrar interface {
+	handle(method, path string, handler RequestHandler, origin interface{}, name []string)
+}
+
+//returns the description of a route
+func newRouteInfo(method, pattern string, origin interface{}, name []string) RouteInfo {
+	info := RouteInfo{
+		Method:  method,
+		Pattern: pattern,
+		Name:    strings.Join(name, ", "),
+	}
+
+	if len(info.Pattern) == 0 {
+		info.Pattern = "/"
+	}
+
+	info.Handler, info.File, info.Line = funcInfo(origin)
+
+	return info
+}
+
+//returns a copy of routes, so that callers can't modify the original list
+func copyRouteInfo(routes []RouteInfo) []RouteInfo {
+	result := make([]RouteInfo, len(routes))
+	copy(result, routes)
+
+	return result
+}
+
+//returns the location of a route, for error messages
+func (r RouteInfo) String() string {
+	return fmt.Sprintf("%s %s%s (%s at %s:%d)", r.Method, strings.TrimSuffix(r.MountPoint, "/"), r.Pattern, r.Handler, r.File, r.Line)
+}
+
+//returns all paths that a route can match, with parameter names removed,
+//i.e. /users/:id{[0-9]+}/:tab? -> /users/:{[0-9]+}, /users/:{[0-9]+}/:
+func (r RouteInfo) normalized() []string {
+	routes, err := newPrettyRoutes(strings.TrimSuffix(r.Pattern, "/"), nil)
+	if err != nil {
+		return []string{r.Pattern}
+	}
+
+	result := make([]string, 0, len(routes))
+
+	for _, route := range routes {
+		elements := make([]string, len(route.segments))
+		for i, s := range route.segments {
+			switch s.kind {
+			case segmentStatic:
+				elements[i] = s.value
+			case segmentParam:
+				elements[i] = ":"
+				if len(s.constraint) > 0 {
+					elements[i] += "{" + s.constraint + "}"
+				}
+			case segmentCatchAll:
+				elements[i] = "*"
+			}
+		}
+		result = append(result, strings.Join(elements, "/"))
+	}
+
+	return result
+}
+
+//returns the leading static segments of the route, including its mount point
+func (r RouteInfo) staticSegments() []string {
+	_, mpath := splitMountPoint(r.MountPoint)
+
+	segments := make([]string, 0)
+
+	for _, e := range strings.Split(mpath+"/"+r.Pattern, "/") {
+		if strings.HasPrefix(e, ":") || strings.HasPrefix(e, "*") {
+			break
+		}
+		if len(e) > 0 {
+			segments = append(segments, e)
+		}
+	}
+
+	return segments
+}
+
+//Returns a description of each route that can never be reached, because
+//another route or module shadows it. Routes shadow each other if they only
+//differ by the names of their parameters, or if one is registered on a path
+//that belongs to a module mounted deeper than its own. Of two routes for the
+//same path, the later one replaces the first one, which is reported.
+func ShadowedRoutes(routes []RouteInfo) (problems []string) {
+	seen := make(map[string]RouteInfo)
+	mount_points := make(map[string]bool)
+
+	for _, r := range routes {
+		mount_points[r.MountPoint] = true
+
+		for _, path := range r.normalized() {
+			key := r.MountPoint + " " + r.Method + " " + path
+			if other, ok := seen[key]; ok {
+				problems = append(problems, fmt.Sprintf("%s is shadowed by %s", other, r))
+			}
+			seen[key] = r
+		}
+	}
+
+	//routes whose static prefix matches a deeper mount point on the same host
+	for _, r := range routes {
+		host, mpath := splitMountPoint(r.MountPoint)
+		segments := r.staticSegments()
+
+		for mount_point := range mount_points {
+			other_host, other_path := splitMountPoint(mount_point)
+			if other_host != host || len(other_path) <= len(mpath) || !strings.HasPrefix(other_path, strings.TrimSuffix(mpath, "/")+"/") {
+				continue
+			}
+
+			other_segments := strings.Split(strings.Trim(other_path, "/"), "/")
+			if len(other_segments) > len(segments) {
+				continue
+			}
+
+			shadowed := true
+			for i, s := range other_segments {
+				if segments[i] != s {
+					shadowed = false
+					break
+				}
+			}
+
+			if shadowed {
+				problems = append(problems, fmt.Sprintf("%s is shadowed by the module mounted on %s", r, mount_point))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+
+	return
+}
+
+var routeTableTemplate = template.Must(template.New("routes").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Routes</title></head>
+<body>
+<table>
+<tr><th>Method</th><th>Mount Point</th><th>Pattern</th><th>Name</th><th>Handler</th><th>Source</th></tr>
+{{range .}}<tr><td>{{.Method}}</td><td>{{.MountPoint}}</td><td>{{.Pattern}}</td><td>{{.Name}}</td><td>{{.Handler}}</td><td>{{.File}}:{{.Line}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+//Returns a handler that lists all routes, as JSON if the client accepts it
+//(or if the 'format' query parameter is 'json'), or as an HTML table.
+//It is not registered by default, since the list reveals the source code
+//layout of the application:
+//	module.Get("/routes", perfect.RouteTable(perfect.Modules))
+func RouteTable(routes RouteLister) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		list := routes.Routes()
+
+		if r.Values.Get("format") == "json" || wantsJSON(r) {
+			data, err := json.MarshalIndent(list, "", "  ")
+			if err != nil {
+				Error(w, r, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		err := routeTableTemplate.Execute(w, list)
+		if err != nil {
+			LogError(r, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package perfect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func routesTestHandler(w http.ResponseWriter, r *Request) {}
+
+func TestMux_Routes(t *testing.T) {
+	mux := NewPrettyMux()
+
+	mux.Get("/", routesTestHandler, "home")
+	mux.Group("/admin", func(handler RequestHandler) RequestHandler {
+		return handler
+	}).Post("/users/:id", routesTestHandler)
+
+	routes := mux.Routes()
+	if len(routes) != 2 {
+		t.Fatalf("len(routes) is %v, expected 2", len(routes))
+	}
+
+	expected := []struct {
+		Method, Pattern, Name string
+	}{
+		{"GET", "/", "home"},
+		{"POST", "/admin/users/:id", ""},
+	}
+
+	for i, e := range expected {
+		r := routes[i]
+		if r.Method != e.Method || r.Pattern != e.Pattern || r.Name != e.Name {
+			t.Errorf("route #%v is %v %v (%v), expected %v %v (%v)", i, r.Method, r.Pattern, r.Name, e.Method, e.Pattern, e.Name)
+		}
+
+		//groups must report the original handler, not the middleware wrapper
+		if !strings.HasSuffix(r.Handler, ".routesTestHandler") {
+			t.Errorf("route #%v handler is %v, expected routesTestHandler", i, r.Handler)
+		}
+
+		if !strings.HasSuffix(r.File, "routes_test.go") || r.Line <= 0 {
+			t.Errorf("route #%v source is %v:%v, expected routes_test.go", i, r.File, r.Line)
+		}
+	}
+}
+
+func TestModuleMux_Routes(t *testing.T) {
+	mux := NewModuleMux()
+
+	root := &Module{Name: "root", Mux: NewHTTPMux()}
+	root.Get("/login", routesTestHandler)
+	mux.Mount(root, "/")
+
+	api := &Module{Name: "api", Mux: NewPrettyMux()}
+	api.Get("/forms/:id", routesTestHandler)
+	mux.Mount(api, "/api")
+
+	routes := mux.Routes()
+	if len(routes) != 2 {
+		t.Fatalf("len(routes) is %v, expected 2", len(routes))
+	}
+
+	if routes[0].MountPoint != "/" || routes[1].MountPoint != "/api" {
+		t.Errorf("mount points are %v and %v, expected / and /api", routes[0].MountPoint, routes[1].MountPoint)
+	}
+
+	//JSON route table
+	table := RouteTable(mux)
+
+	http_request := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/routes"},
+		Header: http.Header{"Accept": {"application/json"}},
+	}
+
+	response := httptest.NewRecorder()
+	table(response, NewRequest(http_request, "/routes", root))
+
+	actual := []RouteInfo{}
+	err := json.Unmarshal(response.Body.Bytes(), &actual)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if len(actual) != 2 || actual[1].Pattern != "/forms/:id" {
+		t.Errorf("route table is %v, expected %v", actual, routes)
+	}
+
+	//HTML route table
+	http_request.Header = http.Header{}
+	response = httptest.NewRecorder()
+	table(response, NewRequest(http_request, "/routes", root))
+
+	if !strings.Contains(response.Body.String(), "<td>/forms/:id</td>") {
+		t.Errorf("route table is %v, expected an HTML table", response.Body.String())
+	}
+}
+
+func TestShadowedRoutes(t *testing.T) {
+	route := func(mount_point, method, pattern string) RouteInfo {
+		return RouteInfo{MountPoint: mount_point, Method: method, Pattern: pattern}
+	}
+
+	tests := []struct {
+		Routes   []RouteInfo
+		Shadowed int
+	}{
+		//static routes take priority over parameters
+		{[]RouteInfo{route("/", "GET", "/users/:id"), route("/", "GET", "/users/new")}, 0},
+		//different methods
+		{[]RouteInfo{route("/", "GET", "/users/:id"), route("/", "POST", "/users/:name")}, 0},
+		//different constraints
+		{[]RouteInfo{route("/", "GET", "/users/:id{[0-9]+}"), route("/", "GET", "/users/:name")}, 0},
+		//same route, different parameter names
+		{[]RouteInfo{route("/", "GET", "/users/:id"), route("/", "GET", "/users/:name")}, 1},
+		//the same route twice
+		{[]RouteInfo{route("/", "GET", "/users/:id"), route("/", "GET", "/users/:id")}, 1},
+		{[]RouteInfo{route("/api", "GET", "/"), route("/api", "GET", "/"), route("/api", "GET", "/")}, 2},
+		//optional segments
+		{[]RouteInfo{route("/", "GET", "/archive"), route("/", "GET", "/archive/:year?")}, 1},
+		//deeper mount points
+		{[]RouteInfo{route("/", "GET", "/api/users"), route("/api", "GET", "/users")}, 1},
+		{[]RouteInfo{route("/", "GET", "/apis/users"), route("/api", "GET", "/users")}, 0},
+		{[]RouteInfo{route("/", "GET", "/:api/users"), route("/api", "GET", "/users")}, 0},
+		{[]RouteInfo{route("/", "GET", "/api"), route("/api", "GET", "/")}, 1},
+		{[]RouteInfo{route("admin.example.com/", "GET", "/api/users"), route("/api", "GET", "/users")}, 0},
+	}
+
+	for i, test := range tests {
+		problems := ShadowedRoutes(test.Routes)
+		if len(problems) != test.Shadowed {
+			t.Errorf("#%v: shadowed routes are %v, expected %v", i, problems, test.Shadowed)
+		}
+	}
+
+	//the later route replaces the first one, which is reported
+	problems := ShadowedRoutes([]RouteInfo{route("/", "GET", "/a/:id"), route("/", "GET", "/a/:name")})
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "GET /a/:id ") {
+		t.Errorf("shadowed routes are %v, expected GET /a/:id", problems)
+	}
+}
+
+func TestHTTPMux_DuplicateRoutes(t *testing.T) {
+	var matched string
+
+	mux := NewHTTPMux()
+	mux.Get("/users", func(w http.ResponseWriter, r *Request) { matched = "first" })
+	mux.Post("/users", routesTestHandler)
+	mux.Get("/users", func(w http.ResponseWriter, r *Request) { matched = "second" })
+
+	request := NewRequest(&http.Request{Method: "GET", URL: &url.URL{Path: "/users"}, Header: http.Header{}}, "/users", &Module{})
+	mux.FindHandler(request)(httptest.NewRecorder(), request)
+
+	if matched != "second" {
+		t.Errorf("matched %q, expected the later route", matched)
+	}
+
+	//every registration is listed, and the replaced one is reported
+	routes := mux.Routes()
+	if len(routes) != 3 {
+		t.Errorf("routes = %v", routes)
+	}
+
+	if problems := ShadowedRoutes(routes); len(problems) != 1 || !strings.HasPrefix(problems[0], routes[0].String()+" is shadowed") {
+		t.Errorf("shadowed routes are %v, expected the first GET /users", problems)
+	}
+}
@@ -0,0 +1,348 @@
+package perfect
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//the Cache-Control value used for static files, unless configured
+	//otherwise. Browsers may cache files, but must revalidate them.
+	STATIC_CACHE_CONTROL = "no-cache"
+)
+
+//precompressed variants of static files, in order of preference
+var staticEncodings = []struct {
+	Encoding, Ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+//the cached ETag of a file
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+//Serves static files with strong ETags, configurable Cache-Control headers
+//and precompressed variants. Directory listings are never served.
+type StaticFiles struct {
+	//Files are read from FS if set. Otherwise, they are read from the
+	//module's directory, under the static prefix, and symbolic links that
+	//point outside of that directory are not followed.
+	FS fs.FS
+
+	//Cache-Control values for paths that start with a prefix, relative to
+	//the static prefix. The longest matching prefix wins.
+	CacheControl map[string]string
+
+	//The Cache-Control value for all other paths
+	DefaultCacheControl string
+
+	lock     sync.RWMutex
+	etags    map[string]staticETag
+	manifest *AssetManifest
+}
+
+//returns a new StaticFiles that reads files from fsys, or from the module's
+//directory if fsys is nil
+func NewStaticFiles(fsys fs.FS) *StaticFiles {
+	return &StaticFiles{
+		FS:                  fsys,
+		CacheControl:        make(map[string]string),
+		DefaultCacheControl: STATIC_CACHE_CONTROL,
+		etags:               make(map[string]staticETag),
+	}
+}
+
+//sets the Cache-Control value for all files whose path starts with prefix
+func (s *StaticFiles) SetCacheControl(prefix, value string) {
+	s.lock.Lock()
+	s.CacheControl[prefix] = value
+	s.lock.Unlock()
+}
+
+//sets the manifest that resolves fingerprinted asset names
+func (s *StaticFiles) SetManifest(manifest *AssetManifest) {
+	s.lock.Lock()
+	s.manifest = manifest
+	s.lock.Unlock()
+}
+
+//returns the asset manifest, or nil if there isn't one
+func (s *StaticFiles) Manifest() *AssetManifest {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.manifest
+}
+
+//returns the Cache-Control value for the file
+func (s *StaticFiles) cacheControl(name string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	value := s.DefaultCacheControl
+	longest := -1
+
+	for prefix, v := range s.CacheControl {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if len(prefix) > longest && strings.HasPrefix(name, prefix) {
+			value = v
+			longest = len(prefix)
+		}
+	}
+
+	return value
+}
+
+//a file system rooted at a directory, which refuses to open files whose
+//real path (after following symbolic links) is outside of that directory
+type confinedDir struct {
+	root string
+}
+
+func (d confinedDir) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+
+	return os.Open(resolved)
+}
+
+//returns the file system that holds the static files of the module
+func (s *StaticFiles) fileSystem(m *Module, prefix string) (fs.FS, string) {
+	if s.FS != nil {
+		return s.FS, ""
+	}
+
+	root := filepath.Join(m.Path, filepath.FromSlash(prefix))
+
+	return confinedDir{root: root}, root
+}
+
+//returns the strong ETag of the file's contents, computing it only if the
+//file has changed since it was last computed
+func (s *StaticFiles) etag(key string, content io.Reader, info fs.FileInfo) (string, error) {
+	s.lock.RLock()
+	cached, ok := s.etags[key]
+	s.lock.RUnlock()
+
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	s.lock.Lock()
+	if s.etags == nil {
+		s.etags = make(map[string]staticETag)
+	}
+	s.etags[key] = staticETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	s.lock.Unlock()
+
+	return etag, nil
+}
+
+//opens a regular file, returning an error for directories
+func openRegular(fsys fs.FS, name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fs.ErrNotExist
+	}
+
+	return f, info, nil
+}
+
+//checks whether the client accepts a content encoding. The encoding's own
+//token takes precedence over '*', and encodings with a quality value of 0
+//are not accepted.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	specific, wildcard := -1.0, -1.0
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accepted, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+
+		if name == encoding {
+			specific = math.Max(specific, q)
+		} else {
+			wildcard = math.Max(wildcard, q)
+		}
+	}
+
+	if specific >= 0 {
+		return specific > 0
+	}
+
+	return wildcard > 0
+}
+
+//returns the content type of a file, based on its extension, or on its
+//first 512 bytes if the extension is unknown
+func contentType(fsys fs.FS, name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); len(t) > 0 {
+		return t
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+
+	data := make([]byte, 512)
+	n, _ := io.ReadFull(f, data)
+
+	return http.DetectContentType(data[:n])
+}
+
+//Serves a static file. name is relative to the static prefix, and can be
+//the fingerprinted name of an asset, which is served with immutable cache
+//headers. Responds with 404 Not Found for directories, missing files and
+//paths outside of the static root.
+func (s *StaticFiles) Serve(w http.ResponseWriter, r *Request, prefix, name string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	if len(name) == 0 || !fs.ValidPath(name) {
+		NotFound(w, r)
+		return
+	}
+
+	fsys, root := s.fileSystem(r.Module, prefix)
+
+	cache_control := ""
+	if manifest := s.Manifest(); manifest != nil {
+		if original, ok := manifest.resolve(name); ok {
+			name = original
+			cache_control = ASSET_CACHE_CONTROL
+		}
+	}
+
+	if len(cache_control) == 0 {
+		cache_control = s.cacheControl(name)
+	}
+
+	f, info, err := openRegular(fsys, name)
+	if err != nil {
+		NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", contentType(fsys, name))
+	header.Set("Cache-Control", cache_control)
+	addVary(header, "Accept-Encoding")
+
+	//serve precompressed variants, unless a range was requested (ranges
+	//apply to the uncompressed file)
+	if len(r.Header.Get("Range")) == 0 {
+		for _, e := range staticEncodings {
+			if !acceptsEncoding(r.Request, e.Encoding) {
+				continue
+			}
+
+			cf, cinfo, err := openRegular(fsys, name+e.Ext)
+			if err != nil {
+				continue
+			}
+			defer cf.Close()
+
+			f, info = cf, cinfo
+			name += e.Ext
+			header.Set("Content-Encoding", e.Encoding)
+			break
+		}
+	}
+
+	s.serveContent(w, r, root+":"+name, f, info)
+}
+
+//writes the contents of the file, with its ETag
+func (s *StaticFiles) serveContent(w http.ResponseWriter, r *Request, key string, f fs.File, info fs.FileInfo) {
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			Error(w, r, err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := s.etag(key, content, info)
+	if err != nil {
+		Error(w, r, err)
+		return
+	}
+
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+
+	http.ServeContent(w, r.Request, info.Name(), info.ModTime(), content)
+}
@@ -0,0 +1,233 @@
+package perfect
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+//returns a module that serves static files from a temporary directory
+func newStaticTestModule(t *testing.T) (*Module, string) {
+	dir, err := ioutil.TempDir("", "perfect-static")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	files := map[string]string{
+		"static/app.js":          "console.log('app');",
+		"static/app.js.gz":       "gzipped app",
+		"static/app.js.br":       "brotli app",
+		"static/css/site.css":    "body{}",
+		"static/vendor/lib.js":   "lib",
+		"static/docs/index.html": "<p>docs</p>",
+		"secret.txt":             "secret",
+	}
+
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("err = %v", err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("err = %v", err)
+		}
+	}
+
+	//a symlink that escapes the static directory
+	err = os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(dir, "static", "secret.txt"))
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	module := &Module{Name: "static", Path: dir, Mux: NewHTTPMux()}
+	module.Static("/static")
+
+	return module, dir
+}
+
+//sends a GET request to the module and returns the response
+func getStatic(module *Module, path string, header map[string]string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+
+	w := httptest.NewRecorder()
+	module.Route(w, NewRequest(request, path, module))
+
+	return w
+}
+
+func TestStaticFiles_Serve(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/static/app.js", http.StatusOK, "console.log('app');"},
+		{"/static/css/site.css", http.StatusOK, "body{}"},
+		{"/static/", http.StatusNotFound, ""},
+		{"/static/css", http.StatusNotFound, ""},
+		{"/static/docs/", http.StatusNotFound, ""},
+		{"/static/missing.js", http.StatusNotFound, ""},
+		{"/static/../secret.txt", http.StatusNotFound, ""},
+		{"/static/css/../../secret.txt", http.StatusNotFound, ""},
+		{"/static/secret.txt", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		w := getStatic(module, test.Path, nil)
+
+		if w.Code != test.Status {
+			t.Errorf("%v: status = %v, expected %v", test.Path, w.Code, test.Status)
+			continue
+		}
+
+		if test.Status == http.StatusOK && w.Body.String() != test.Body {
+			t.Errorf("%v: body = %q, expected %q", test.Path, w.Body.String(), test.Body)
+		}
+	}
+}
+
+func TestStaticFiles_ETag(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	w := getStatic(module, "/static/css/site.css", nil)
+
+	etag := w.Header().Get("ETag")
+	if len(etag) == 0 {
+		t.Fatalf("ETag is missing")
+	}
+
+	if w.Header().Get("Cache-Control") != STATIC_CACHE_CONTROL {
+		t.Errorf("Cache-Control = %v, expected %v", w.Header().Get("Cache-Control"), STATIC_CACHE_CONTROL)
+	}
+
+	w = getStatic(module, "/static/css/site.css", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status = %v, expected %v", w.Code, http.StatusNotModified)
+	}
+
+	//the ETag changes with the contents of the file
+	err := ioutil.WriteFile(filepath.Join(dir, "static", "css", "site.css"), []byte("body{color:red}"), 0644)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	w = getStatic(module, "/static/css/site.css", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %v, expected %v", w.Code, http.StatusOK)
+	}
+
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("ETag = %v, expected a new ETag", etag)
+	}
+}
+
+func TestStaticFiles_CacheControl(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	static := module.StaticFiles()
+	static.SetCacheControl("/vendor", "public, max-age=31536000, immutable")
+	static.SetCacheControl("/css/", "public, max-age=3600")
+
+	tests := []struct {
+		Path, CacheControl string
+	}{
+		{"/static/vendor/lib.js", "public, max-age=31536000, immutable"},
+		{"/static/css/site.css", "public, max-age=3600"},
+		{"/static/app.js", STATIC_CACHE_CONTROL},
+	}
+
+	for _, test := range tests {
+		w := getStatic(module, test.Path, nil)
+		if cc := w.Header().Get("Cache-Control"); cc != test.CacheControl {
+			t.Errorf("%v: Cache-Control = %v, expected %v", test.Path, cc, test.CacheControl)
+		}
+	}
+}
+
+func TestStaticFiles_Precompressed(t *testing.T) {
+	module, dir := newStaticTestModule(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Path, AcceptEncoding, Encoding, Body string
+	}{
+		{"/static/app.js", "gzip, deflate, br", "br", "brotli app"},
+		{"/static/app.js", "gzip", "gzip", "gzipped app"},
+		{"/static/app.js", "br;q=0, gzip", "gzip", "gzipped app"},
+		//the encoding's own token takes precedence over '*'
+		{"/static/app.js", "*;q=0, gzip", "gzip", "gzipped app"},
+		{"/static/app.js", "gzip, *;q=0", "gzip", "gzipped app"},
+		{"/static/app.js", "*, br;q=0", "gzip", "gzipped app"},
+		{"/static/app.js", "*;q=0", "", "console.log('app');"},
+		{"/static/app.js", "", "", "console.log('app');"},
+		{"/static/css/site.css", "gzip, br", "", "body{}"},
+	}
+
+	for _, test := range tests {
+		w := getStatic(module, test.Path, map[string]string{"Accept-Encoding": test.AcceptEncoding})
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != test.Encoding {
+			t.Errorf("%v (%v): Content-Encoding = %v, expected %v", test.Path, test.AcceptEncoding, encoding, test.Encoding)
+		}
+
+		if w.Body.String() != test.Body {
+			t.Errorf("%v (%v): body = %q, expected %q", test.Path, test.AcceptEncoding, w.Body.String(), test.Body)
+		}
+
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%v: Vary = %v, expected Accept-Encoding", test.Path, w.Header().Get("Vary"))
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/javascript" && ct != "text/javascript; charset=utf-8" && ct != "text/css; charset=utf-8" {
+			t.Errorf("%v: Content-Type = %v", test.Path, ct)
+		}
+	}
+
+	//ranges apply to the uncompressed file
+	w := getStatic(module, "/static/app.js", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-6"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "console" {
+		t.Errorf("status = %v, body = %q, expected %v, %q", w.Code, w.Body.String(), http.StatusPartialContent, "console")
+	}
+}
+
+func TestStaticFiles_FS(t *testing.T) {
+	module := &Module{Name: "embedded", Mux: NewPrettyMux()}
+	module.StaticFS("/assets", fstest.MapFS{
+		"logo.svg":      {Data: []byte("<svg></svg>")},
+		"js/main.js":    {Data: []byte("main")},
+		"js/main.js.gz": {Data: []byte("gzipped main")},
+	})
+
+	w := getStatic(module, "/assets/logo.svg", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "<svg></svg>" {
+		t.Errorf("status = %v, body = %q", w.Code, w.Body.String())
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("Content-Type = %v, expected image/svg+xml", ct)
+	}
+
+	w = getStatic(module, "/assets/js/main.js", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Body.String() != "gzipped main" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("body = %q, Content-Encoding = %v", w.Body.String(), w.Header().Get("Content-Encoding"))
+	}
+
+	for _, path := range []string{"/assets/js", "/assets/"} {
+		w = getStatic(module, path, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%v: status = %v, expected %v", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
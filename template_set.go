@@ -0,0 +1,190 @@
+package perfect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+)
+
+//A parsed set of templates, and the copies of it that render requests.
+//html/template escapes a template when it is first executed, and a set
+//can't be cloned after that, so the parsed set is never executed. Each copy
+//is escaped once, the first time it renders, and then renders one request
+//at a time; its request functions read the request from the copy.
+type templateSet struct {
+	templates *template.Template
+	copies    sync.Pool
+}
+
+func newTemplateSet(templates *template.Template) *templateSet {
+	return &templateSet{templates: templates}
+}
+
+//A copy of a template set, and the request it renders
+type renderSet struct {
+	templates *template.Template
+	w         http.ResponseWriter
+	r         *Request
+}
+
+//returns a copy of the set that renders the request, cloning the set only
+//if all copies are in use
+func (s *templateSet) get(w http.ResponseWriter, r *Request) (*renderSet, error) {
+	rs, _ := s.copies.Get().(*renderSet)
+	if rs == nil {
+		clone, err := s.templates.Clone()
+		if err != nil {
+			return nil, err
+		}
+
+		rs = &renderSet{templates: clone}
+		clone.Funcs(rs.funcs())
+	}
+
+	rs.w, rs.r = w, r
+
+	return rs, nil
+}
+
+//returns a copy to the set, once its request has been rendered
+func (s *templateSet) put(rs *renderSet) {
+	rs.w, rs.r = nil, nil
+	s.copies.Put(rs)
+}
+
+//buffers that templates are rendered into
+var templateBuffers = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+//buffers that grew larger than this are not reused, so that one large page
+//doesn't keep its memory
+const maxTemplateBuffer = 1 << 20
+
+//renders the template called name into a buffer, and sends it with the
+//status code if the template didn't fail, so that clients never receive
+//half a page. Template functions can still set headers, i.e. cookies.
+func (s *templateSet) render(w http.ResponseWriter, r *Request, name string, status int, data interface{}) error {
+	rs, err := s.get(w, r)
+	if err != nil {
+		return err
+	}
+	defer s.put(rs)
+
+	tpl := rs.templates.Lookup(name)
+	if tpl == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchTemplate, name)
+	}
+
+	buf := templateBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	defer func() {
+		if buf.Cap() <= maxTemplateBuffer {
+			templateBuffers.Put(buf)
+		}
+	}()
+
+	if err := tpl.Execute(buf, data); err != nil {
+		return err
+	}
+
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+//Returns the template functions that need the request, so that pages don't
+//need to pass the session or the profile in their data. The functions
+//registered before parsing belong to no copy, and have no request.
+func (rs *renderSet) funcs() template.FuncMap {
+	return template.FuncMap{
+		"csrf": func() (string, error) {
+			if rs.r == nil {
+				return "", errors.New("csrf: no request")
+			}
+			return issueCSRFToken(rs.w, rs.r)
+		},
+		//the flash messages of the session, which are removed once shown
+		"flash": func() ([]string, error) {
+			if rs.r == nil {
+				return nil, errors.New("flash: no request")
+			}
+			return rs.r.Flashes()
+		},
+		//the module-relative path of the request, i.e. to highlight links
+		"path": func() string {
+			if rs.r == nil {
+				return ""
+			}
+			return rs.r.URL.Path
+		},
+		//the profile of the user, or nil if they haven't logged in. Visitors
+		//without a session don't get one.
+		"profile": func() (*Profile, error) {
+			if rs.r == nil {
+				return nil, errors.New("profile: no request")
+			}
+			if !rs.r.hasSession() {
+				return nil, nil
+			}
+			return rs.r.Profile()
+		},
+		//the session of the request, which is created if needed
+		"session": func() (*Session, error) {
+			if rs.r == nil {
+				return nil, errors.New("session: no request")
+			}
+			session, err := rs.r.Session()
+			if err != nil {
+				return nil, err
+			}
+			rs.r.sendSessionCookie(rs.w)
+			return session, nil
+		},
+		//renders another template with its own data, i.e.
+		//	<% partial "user" .Owner %>
+		//Partials are found in the 'partials' folder first, then by name.
+		"partial": func(name string, data ...interface{}) (template.HTML, error) {
+			if rs.templates == nil {
+				return "", errors.New("partial: no request")
+			}
+
+			if len(data) > 1 {
+				return "", fmt.Errorf("partial '%s': too many arguments", name)
+			}
+
+			tpl := rs.templates.Lookup(PARTIAL_DIR + "/" + name)
+			if tpl == nil {
+				tpl = rs.templates.Lookup(name)
+			}
+
+			if tpl == nil {
+				return "", fmt.Errorf("partial '%s': no such template", name)
+			}
+
+			var value interface{}
+			if len(data) > 0 {
+				value = data[0]
+			}
+
+			buf := &bytes.Buffer{}
+			if err := tpl.Execute(buf, value); err != nil {
+				return "", err
+			}
+
+			//the partial was escaped when it was executed
+			return template.HTML(buf.String()), nil
+		},
+	}
+}
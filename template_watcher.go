@@ -0,0 +1,96 @@
+package perfect
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//how often development modules check their templates for changes, at most
+	TEMPLATE_POLL_INTERVAL = time.Second
+)
+
+//Reports changes to template files, so that development modules can reload
+//them. Implementations can poll the file system, or use OS notifications.
+type TemplateWatcher interface {
+	//returns true if templates were changed, added or deleted since the
+	//last call, and on the first call
+	Changed() (bool, error)
+}
+
+//the state of a watched file
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+//A TemplateWatcher that compares the modification times and sizes of the
+//files in some folders, at most once every Interval
+type PollingWatcher struct {
+	Dirs     []string
+	Ext      string
+	Interval time.Duration
+
+	lock     sync.Mutex
+	lastPoll time.Time
+	files    map[string]watchedFile
+}
+
+//returns a watcher for the files in dirs (and their subfolders) that have
+//the given extension
+func NewPollingWatcher(ext string, interval time.Duration, dirs ...string) *PollingWatcher {
+	return &PollingWatcher{
+		Dirs:     dirs,
+		Ext:      ext,
+		Interval: interval,
+	}
+}
+
+func (p *PollingWatcher) Changed() (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if p.files != nil && now.Sub(p.lastPoll) < p.Interval {
+		return false, nil
+	}
+	p.lastPoll = now
+
+	files := make(map[string]watchedFile, len(p.files))
+
+	for _, dir := range p.Dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				//folders that don't exist have no files
+				if path == dir && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+
+			if !info.IsDir() && filepath.Ext(path) == p.Ext {
+				files[path] = watchedFile{info.ModTime(), info.Size()}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	changed := p.files == nil || len(files) != len(p.files)
+	for path, file := range files {
+		if previous, ok := p.files[path]; !ok || !previous.modTime.Equal(file.modTime) || previous.size != file.size {
+			changed = true
+			break
+		}
+	}
+
+	p.files = files
+
+	return changed, nil
+}
@@ -0,0 +1,200 @@
+package perfect
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//returns a module folder with the given templates
+func newTemplateTestDir(t testing.TB, templates map[string]string) string {
+	dir, err := ioutil.TempDir("", "perfect-templates")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	for name, content := range templates {
+		writeTemplate(t, dir, name, content)
+	}
+
+	return dir
+}
+
+func writeTemplate(t testing.TB, dir, name, content string) {
+	path := filepath.Join(dir, TEMPLATE_DIR, name+TEMPLATE_EXT)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+//renders a template, and returns the response
+func renderTemplate(module *Module, name string, data interface{}) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	response := httptest.NewRecorder()
+
+	module.RenderTemplate(response, NewRequest(request, "/", module), name, data)
+
+	return response
+}
+
+func TestPollingWatcher(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{"page": "page", "users/list": "list"})
+	defer os.RemoveAll(dir)
+
+	watcher := NewPollingWatcher(TEMPLATE_EXT, 0, filepath.Join(dir, TEMPLATE_DIR))
+
+	steps := []struct {
+		Name    string
+		Change  func()
+		Changed bool
+	}{
+		{"first call", func() {}, true},
+		{"no changes", func() {}, false},
+		{"changed", func() { writeTemplate(t, dir, "page", "new page") }, true},
+		{"added", func() { writeTemplate(t, dir, "users/edit", "edit") }, true},
+		{"deleted", func() { os.Remove(filepath.Join(dir, TEMPLATE_DIR, "users", "list"+TEMPLATE_EXT)) }, true},
+		{"other files", func() { ioutil.WriteFile(filepath.Join(dir, TEMPLATE_DIR, "notes.txt"), []byte("x"), 0644) }, false},
+	}
+
+	for _, step := range steps {
+		step.Change()
+
+		changed, err := watcher.Changed()
+		if err != nil || changed != step.Changed {
+			t.Errorf("%v: changed = %v, err = %v, expected %v", step.Name, changed, err, step.Changed)
+		}
+	}
+
+	//files are only checked once per interval
+	watcher.Interval = time.Hour
+	writeTemplate(t, dir, "page", "newer page")
+
+	if changed, _ := watcher.Changed(); changed {
+		t.Errorf("changed = %v, expected false", changed)
+	}
+}
+
+func TestModule_ReloadTemplates(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{"page": "<p><% .Name %></p>", "error": "<h1><% .Status %></h1>"})
+	defer os.RemoveAll(dir)
+
+	module := &Module{
+		Name:            "reload",
+		Mux:             NewPrettyMux(),
+		Path:            dir,
+		Development:     true,
+		TemplateWatcher: NewPollingWatcher(TEMPLATE_EXT, 0, filepath.Join(dir, TEMPLATE_DIR)),
+	}
+
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	data := map[string]string{"Name": "bob"}
+
+	steps := []struct {
+		Name     string
+		Change   func()
+		Template string
+		Status   int
+		Body     string
+	}{
+		{"parsed", func() {}, "page", http.StatusOK, "<p>bob</p>"},
+		{"changed", func() { writeTemplate(t, dir, "page", "<div><% .Name %></div>") }, "page", http.StatusOK, "<div>bob</div>"},
+		{"added", func() { writeTemplate(t, dir, "users/list", "users of <% .Name %>") }, "users/list", http.StatusOK, "users of bob"},
+		{"parse error", func() { writeTemplate(t, dir, "page", "<div><% .Name </div>") }, "page", http.StatusInternalServerError, "page.html"},
+		{"fixed", func() { writeTemplate(t, dir, "page", "<span><% .Name %></span>") }, "page", http.StatusOK, "<span>bob</span>"},
+		{"deleted", func() { os.Remove(filepath.Join(dir, TEMPLATE_DIR, "users", "list"+TEMPLATE_EXT)) }, "users/list", http.StatusInternalServerError, "<h1>500</h1>"},
+	}
+
+	for _, step := range steps {
+		step.Change()
+
+		response := renderTemplate(module, step.Template, data)
+
+		if response.Code != step.Status || !strings.Contains(response.Body.String(), step.Body) {
+			t.Errorf("%v: status = %v, body = %q, expected %v with %q", step.Name, response.Code, response.Body.String(), step.Status, step.Body)
+		}
+	}
+
+	//execution errors are shown too
+	writeTemplate(t, dir, "page", "<% .Name.Missing %>")
+	response := renderTemplate(module, "page", data)
+
+	if response.Code != http.StatusInternalServerError || !strings.Contains(response.Body.String(), "Template error") {
+		t.Errorf("status = %v, body = %q", response.Code, response.Body.String())
+	}
+}
+
+func TestModule_ProductionTemplates(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{"page": "<p>one</p>"})
+	defer os.RemoveAll(dir)
+
+	module := &Module{Name: "production", Mux: NewPrettyMux(), Path: dir}
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	//templates are parsed once
+	writeTemplate(t, dir, "page", "<p>two</p>")
+
+	if response := renderTemplate(module, "page", nil); response.Body.String() != "<p>one</p>" {
+		t.Errorf("body = %q", response.Body.String())
+	}
+
+	if module.TemplateWatcher != nil {
+		t.Errorf("TemplateWatcher = %#v", module.TemplateWatcher)
+	}
+}
+
+func TestModule_ReloadTemplates_Concurrent(t *testing.T) {
+	dir := newTemplateTestDir(t, map[string]string{"page": "<p>0</p>"})
+	defer os.RemoveAll(dir)
+
+	module := &Module{
+		Name:            "concurrent",
+		Mux:             NewPrettyMux(),
+		Path:            dir,
+		Development:     true,
+		TemplateWatcher: NewPollingWatcher(TEMPLATE_EXT, 0, filepath.Join(dir, TEMPLATE_DIR)),
+	}
+
+	if err := module.ParseTemplates(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				//the file can be read while it's being written, so only the
+				//status is checked
+				response := renderTemplate(module, "page", nil)
+				if response.Code != http.StatusOK {
+					t.Errorf("status = %v, body = %q", response.Code, response.Body.String())
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 10; i++ {
+		writeTemplate(t, dir, "page", "<p>"+strings.Repeat("x", i)+"</p>")
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,14 @@
+package perfecttest
+
+import (
+	"github.com/vpetrov/perfect"
+	"testing"
+)
+
+//fails the test if any route can never be reached, because another route
+//or module shadows it
+func CheckRoutes(routes perfect.RouteLister, t *testing.T) {
+	for _, problem := range perfect.ShadowedRoutes(routes.Routes()) {
+		t.Errorf("%s", problem)
+	}
+}
@@ -0,0 +1,278 @@
+package perfect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	//the request value that holds the label matched by a '*' host pattern
+	SUBDOMAIN = "subdomain"
+)
+
+//a host pattern whose leftmost label is a wildcard, i.e. *.example.com
+type wildcardHost struct {
+	suffix string //i.e. ".example.com"
+	key    string //the name of the request value that holds the label
+	root   *mountNode
+}
+
+//splits a mount point into its host pattern and path,
+//i.e. admin.example.com/api -> admin.example.com, /api
+func splitMountPoint(mount_point string) (host, path string) {
+	i := strings.Index(mount_point, "/")
+	if i < 0 {
+		return strings.ToLower(mount_point), ""
+	}
+
+	return strings.ToLower(mount_point[:i]), mount_point[i:]
+}
+
+//returns an error if host can't be used as a host pattern. Host patterns
+//are host names whose leftmost label can be '*' or ':name'.
+func checkHostPattern(host string) error {
+	if len(host) == 0 {
+		return nil
+	}
+
+	for i, label := range strings.Split(host, ".") {
+		if i == 0 && (label == "*" || (strings.HasPrefix(label, ":") && len(label) > 1)) {
+			continue
+		}
+
+		if len(label) == 0 {
+			return fmt.Errorf("%s '%s': empty host label", ErrInvalidMountPoint, host)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("%s '%s': invalid character in host label '%s'", ErrInvalidMountPoint, host, label)
+			}
+		}
+	}
+
+	return nil
+}
+
+//returns the mount tree for a valid host pattern, creating it if create is
+//true. The empty pattern matches all hosts.
+func (mux *ModuleMux) hostRoot(host string, create bool) *mountNode {
+	if len(host) == 0 {
+		return mux.root
+	}
+
+	//exact host names
+	if !strings.HasPrefix(host, "*.") && !strings.HasPrefix(host, ":") {
+		root, ok := mux.hosts[host]
+		if !ok && create {
+			root = &mountNode{}
+			mux.hosts[host] = root
+		}
+		return root
+	}
+
+	dot := strings.Index(host, ".")
+	suffix := host[dot:]
+
+	key := host[1:dot]
+	if host[0] == '*' {
+		key = SUBDOMAIN
+	}
+
+	for _, wildcard := range mux.wildcards {
+		if wildcard.suffix == suffix {
+			if wildcard.key != key {
+				//*.example.com and :tenant.example.com can't coexist
+				return nil
+			}
+			return wildcard.root
+		}
+	}
+
+	if !create {
+		return nil
+	}
+
+	wildcard := &wildcardHost{
+		suffix: suffix,
+		key:    key,
+		root:   &mountNode{},
+	}
+
+	//keep the longest (most specific) suffixes first
+	i := 0
+	for i < len(mux.wildcards) && len(mux.wildcards[i].suffix) >= len(suffix) {
+		i++
+	}
+
+	mux.wildcards = append(mux.wildcards, nil)
+	copy(mux.wildcards[i+1:], mux.wildcards[i:])
+	mux.wildcards[i] = wildcard
+
+	return wildcard.root
+}
+
+//removes the mount tree of a host pattern once no module is mounted on it,
+//so that a stale wildcard can't keep matching requests, or keep a different
+//wildcard for the same suffix from being mounted
+func (mux *ModuleMux) pruneHost(host string) {
+	if len(host) == 0 {
+		return
+	}
+
+	for key := range mux.modules {
+		if other, _ := splitMountPoint(key); other == host {
+			return
+		}
+	}
+
+	if _, ok := mux.hosts[host]; ok {
+		delete(mux.hosts, host)
+		return
+	}
+
+	suffix := host[strings.Index(host, "."):]
+	for i, wildcard := range mux.wildcards {
+		if wildcard.suffix == suffix {
+			mux.wildcards = append(mux.wildcards[:i], mux.wildcards[i+1:]...)
+			return
+		}
+	}
+}
+
+//finds the mount tree for the host of a request. Exact host names take
+//priority over wildcards. For wildcards, the name and value of the matched
+//label are returned as well.
+func (mux *ModuleMux) findHost(host string) (root *mountNode, key, label string) {
+	if root, ok := mux.hosts[host]; ok {
+		return root, "", ""
+	}
+
+	for _, wildcard := range mux.wildcards {
+		if !strings.HasSuffix(host, wildcard.suffix) {
+			continue
+		}
+
+		//wildcards match exactly one label
+		label = host[:len(host)-len(wildcard.suffix)]
+		if len(label) > 0 && !strings.Contains(label, ".") {
+			return wildcard.root, wildcard.key, label
+		}
+	}
+
+	return nil, "", ""
+}
+
+//Sets the list of proxies whose X-Forwarded-Host and X-Forwarded-For
+//headers are trusted.
+//Each proxy is an IP address or a CIDR block, i.e. 10.0.0.0/8.
+func (mux *ModuleMux) TrustProxies(proxies ...string) error {
+	networks := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid proxy address '%s'", proxy)
+			}
+
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return err
+		}
+
+		networks = append(networks, network)
+	}
+
+	mux.lock.Lock()
+	mux.trustedProxies = networks
+	mux.lock.Unlock()
+
+	return nil
+}
+
+//checks whether the request was sent by a trusted proxy
+func (mux *ModuleMux) isTrustedProxy(r *http.Request) bool {
+	return mux.isTrusted(remoteIP(r))
+}
+
+//checks whether addr belongs to a trusted proxy
+func (mux *ModuleMux) isTrusted(addr string) bool {
+	if len(mux.trustedProxies) == 0 {
+		return false
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range mux.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//returns the address of the peer that sent the request, without the port
+func remoteIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	return addr
+}
+
+//returns the address of the client. Requests from trusted proxies are
+//followed through X-Forwarded-For, from the last proxy back to the first
+//address that isn't a trusted proxy, since clients can send any value.
+func (mux *ModuleMux) clientIP(r *http.Request) string {
+	addr := remoteIP(r)
+	if !mux.isTrusted(addr) {
+		return addr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		addr = hop
+		if !mux.isTrusted(hop) {
+			break
+		}
+	}
+
+	return addr
+}
+
+//returns the lowercase host name of the request, without the port.
+//X-Forwarded-Host is only used for requests from trusted proxies.
+func (mux *ModuleMux) requestHost(r *http.Request) string {
+	host := r.Host
+
+	if forwarded := r.Header.Get("X-Forwarded-Host"); len(forwarded) > 0 && mux.isTrustedProxy(r) {
+		//the first host is the one the client asked for
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
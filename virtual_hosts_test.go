@@ -0,0 +1,177 @@
+package perfect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestModuleMux_VirtualHosts(t *testing.T) {
+	mux := NewModuleMux()
+
+	mounts := []string{
+		"/",
+		"/api",
+		"admin.example.com/",
+		"*.tenant.example.com/",
+		"*.eu.tenant.example.com/",
+		":account.example.org/api",
+	}
+
+	for _, mount_point := range mounts {
+		name := mount_point
+		module := &Module{Name: name, Mux: NewHTTPMux()}
+		module.Get("/info", func(w http.ResponseWriter, r *Request) {
+			w.Write([]byte(name + " " + r.URL.Path + " " + r.Values.Get(SUBDOMAIN) + r.Values.Get("account")))
+		})
+
+		if err := mux.Mount(module, mount_point); err != nil {
+			t.Fatalf("Mount(%v): err = %v", mount_point, err)
+		}
+	}
+
+	err := mux.TrustProxies("10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	tests := []struct {
+		Host, Forwarded, RemoteAddr, Path, Expected string
+	}{
+		{"example.com", "", "1.2.3.4:1000", "/info", "/ /info "},
+		{"example.com", "", "1.2.3.4:1000", "/api/info", "/api /info "},
+		{"Admin.Example.com:8080", "", "1.2.3.4:1000", "/info", "admin.example.com/ /info "},
+		{"admin.example.com", "", "1.2.3.4:1000", "/api/info", "Not Found\n"},
+		{"acme.tenant.example.com", "", "1.2.3.4:1000", "/info", "*.tenant.example.com/ /info acme"},
+		{"acme.eu.tenant.example.com", "", "1.2.3.4:1000", "/info", "*.eu.tenant.example.com/ /info acme"},
+		{"a.b.tenant.example.com", "", "1.2.3.4:1000", "/info", "/ /info "},
+		{"tenant.example.com", "", "1.2.3.4:1000", "/info", "/ /info "},
+		{"bob.example.org", "", "1.2.3.4:1000", "/api/info", ":account.example.org/api /info bob"},
+		{"bob.example.org", "", "1.2.3.4:1000", "/info", "/ /info "},
+		{"example.com", "admin.example.com", "10.1.2.3:1000", "/info", "admin.example.com/ /info "},
+		{"example.com", "admin.example.com, proxy.local", "192.168.1.1:1000", "/info", "admin.example.com/ /info "},
+		{"example.com", "admin.example.com", "192.168.1.2:1000", "/info", "/ /info "},
+		{"example.com", "admin.example.com", "1.2.3.4:1000", "/info", "/ /info "},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "http://"+test.Host+test.Path, nil)
+		request.Host = test.Host
+		request.RemoteAddr = test.RemoteAddr
+		if len(test.Forwarded) > 0 {
+			request.Header.Set("X-Forwarded-Host", test.Forwarded)
+		}
+
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+
+		if response.Body.String() != test.Expected {
+			t.Errorf("%v%v (forwarded: '%v' by %v) body is '%v', expected '%v'", test.Host, test.Path, test.Forwarded, test.RemoteAddr, response.Body.String(), test.Expected)
+		}
+	}
+
+	invalid := []string{"admin.example.com", "a..example.com/", "api.*.example.com/", "ex ample.com/", "*.example.org/"}
+	for _, mount_point := range invalid {
+		if err := mux.Mount(&Module{Mux: NewHTTPMux()}, mount_point); err == nil {
+			t.Errorf("Mount(%v) succeeded, expected an error", mount_point)
+		}
+	}
+}
+
+func TestModuleMux_UnmountHosts(t *testing.T) {
+	mux := NewModuleMux()
+
+	mount := func(mount_point string) {
+		module := &Module{Name: mount_point, Mux: NewHTTPMux()}
+		module.Get("/info", func(w http.ResponseWriter, r *Request) {
+			w.Write([]byte(module.Name + " " + r.Values.Get(SUBDOMAIN) + r.Values.Get("tenant")))
+		})
+
+		if err := mux.Mount(module, mount_point); err != nil {
+			t.Fatalf("Mount(%v): err = %v", mount_point, err)
+		}
+	}
+
+	get := func(host string) string {
+		request, _ := http.NewRequest("GET", "http://"+host+"/info", nil)
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response.Body.String()
+	}
+
+	mount("/")
+	mount("*.example.com/")
+	mount("*.example.com/api")
+	mount("admin.example.org/")
+
+	for _, mount_point := range []string{"*.example.com/", "*.example.com/api", "admin.example.org/"} {
+		if err := mux.Unmount(mount_point, context.Background()); err != nil {
+			t.Fatalf("Unmount(%v): err = %v", mount_point, err)
+		}
+	}
+
+	//hosts without modules fall back to the modules mounted on all hosts
+	for _, host := range []string{"acme.example.com", "admin.example.org"} {
+		if body := get(host); body != "/ " {
+			t.Errorf("%v: body = %q, expected %q", host, body, "/ ")
+		}
+	}
+
+	//another wildcard can use the suffix
+	mount(":tenant.example.com/")
+	if body := get("acme.example.com"); body != ":tenant.example.com/ acme" {
+		t.Errorf("body = %q, expected %q", body, ":tenant.example.com/ acme")
+	}
+
+	if len(mux.hosts) != 0 || len(mux.wildcards) != 1 {
+		t.Errorf("hosts = %v, wildcards = %v", mux.hosts, mux.wildcards)
+	}
+}
+
+func TestModuleMux_ClientIP(t *testing.T) {
+	mux := NewModuleMux()
+
+	module := &Module{Name: "ip", Mux: NewHTTPMux()}
+	module.Get("/", func(w http.ResponseWriter, r *Request) {
+		key, _ := KeyByIP(r)
+		w.Write([]byte(key))
+	})
+
+	if err := mux.Mount(module, "/"); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if err := mux.TrustProxies("10.0.0.0/8", "192.168.1.1"); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	tests := []struct {
+		Forwarded, RemoteAddr, Expected string
+	}{
+		{"", "1.2.3.4:1000", "ip:1.2.3.4"},
+		{"5.6.7.8", "1.2.3.4:1000", "ip:1.2.3.4"},
+		{"5.6.7.8", "10.1.2.3:1000", "ip:5.6.7.8"},
+		{"", "10.1.2.3:1000", "ip:10.1.2.3"},
+		//clients can prepend any address; only the proxies' hops count
+		{"9.9.9.9, 5.6.7.8", "10.1.2.3:1000", "ip:5.6.7.8"},
+		{"9.9.9.9, 5.6.7.8, 192.168.1.1", "10.1.2.3:1000", "ip:5.6.7.8"},
+		{"10.0.0.2, 192.168.1.1", "10.1.2.3:1000", "ip:10.0.0.2"},
+		{"unknown", "10.1.2.3:1000", "ip:10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("GET", "http://example.com/", nil)
+		request.RemoteAddr = test.RemoteAddr
+		if len(test.Forwarded) > 0 {
+			request.Header.Set("X-Forwarded-For", test.Forwarded)
+		}
+
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+
+		if response.Body.String() != test.Expected {
+			t.Errorf("%v (forwarded: '%v'): key = %v, expected %v", test.RemoteAddr, test.Forwarded, response.Body.String(), test.Expected)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package perfect
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/vpetrov/perfect/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//message types
+const (
+	WS_TEXT   = 1
+	WS_BINARY = 2
+)
+
+//close codes (RFC 6455, section 7.4.1)
+const (
+	WS_CLOSE_NORMAL           = 1000
+	WS_CLOSE_GOING_AWAY       = 1001
+	WS_CLOSE_PROTOCOL_ERROR   = 1002
+	WS_CLOSE_UNSUPPORTED_DATA = 1003
+	WS_CLOSE_NO_STATUS        = 1005
+	WS_CLOSE_ABNORMAL         = 1006
+	WS_CLOSE_INVALID_PAYLOAD  = 1007
+	WS_CLOSE_POLICY_VIOLATION = 1008
+	WS_CLOSE_MESSAGE_TOO_BIG  = 1009
+	WS_CLOSE_INTERNAL_ERROR   = 1011
+)
+
+const (
+	//the default maximum size of a message, in bytes
+	WS_MAX_MESSAGE_SIZE = 1 << 20
+
+	//how long Close waits to send the close frame
+	WS_CLOSE_TIMEOUT = 5 * time.Second
+
+	//appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+//frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+//Handles a WebSocket connection. The connection is closed when the handler
+//returns. r is the request that opened the connection, so that r.Session()
+//and r.Profile() can be used for authentication.
+type WebSocketHandler func(ws *WebSocket, r *Request)
+
+//Decides whether a WebSocket connection can be opened from a page on
+//another site. Since browsers send cookies with WebSocket handshakes, the
+//default only accepts requests without an Origin, or from the same host.
+var CheckWebSocketOrigin = func(r *Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+//The close frame sent or received by a connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+//A WebSocket connection (RFC 6455). Reads must happen on one goroutine at a
+//time, while writes can happen on any number of goroutines.
+type WebSocket struct {
+	//messages larger than this are refused with WS_CLOSE_MESSAGE_TOO_BIG
+	MaxMessageSize int64
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeLock sync.Mutex
+	closed    bool //set after the close frame has been sent
+}
+
+//checks whether a comma-separated header contains token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//returns the http.Hijacker of a response writer, looking through writers
+//that wrap other writers
+func findHijacker(w http.ResponseWriter) http.Hijacker {
+	for {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			return hijacker
+		}
+
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+//returns the Sec-WebSocket-Accept value for a key
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+//Completes the WebSocket handshake and takes over the connection. If the
+//handshake fails, an error response has already been sent.
+func (r *Request) UpgradeWebSocket(w http.ResponseWriter) (*WebSocket, error) {
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, fmt.Errorf("%s: not a WebSocket upgrade request", ErrInvalidHandshake)
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%s: unsupported version '%s'", ErrInvalidHandshake, r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, fmt.Errorf("%s: invalid key", ErrInvalidHandshake)
+	}
+
+	if !CheckWebSocketOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, fmt.Errorf("%s: origin '%s' is not allowed", ErrInvalidHandshake, r.Header.Get("Origin"))
+	}
+
+	hijacker := findHijacker(w)
+	if hijacker == nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, ErrNotHijackable
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	//the deadlines of http.Server.ReadTimeout and WriteTimeout would cut off
+	//long-lived sockets
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocket{
+		MaxMessageSize: WS_MAX_MESSAGE_SIZE,
+		conn:           conn,
+		reader:         buf.Reader,
+	}, nil
+}
+
+//returns a handler that upgrades requests and runs handler. Panics close the
+//connection with WS_CLOSE_INTERNAL_ERROR, and are passed on to the module mux.
+func webSocketHandler(handler WebSocketHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *Request) {
+		ws, err := r.UpgradeWebSocket(w)
+		if err != nil {
+			if r.Module != nil && r.Module.Log != nil {
+				r.Module.Log.Println(err)
+			}
+			return
+		}
+
+		defer func() {
+			if r_err := recover(); r_err != nil {
+				ws.Close(WS_CLOSE_INTERNAL_ERROR, "")
+				panic(r_err)
+			}
+			ws.Close(WS_CLOSE_NORMAL, "")
+		}()
+
+		handler(ws, r)
+	}
+}
+
+//writes a single, final frame
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	return ws.writeFrameLocked(opcode, payload)
+}
+
+func (ws *WebSocket) writeFrameLocked(opcode byte, payload []byte) error {
+	if ws.closed {
+		return ErrWebSocketClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if opcode == wsClose {
+		ws.closed = true
+		ws.conn.SetWriteDeadline(time.Now().Add(WS_CLOSE_TIMEOUT))
+	}
+
+	//servers don't mask frames
+	_, err := ws.conn.Write(append(header, payload...))
+
+	return err
+}
+
+//a frame read from the client
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+//reads a frame. limit is the maximum size of the payload.
+func (ws *WebSocket) readFrame(limit int64) (*wsFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, header); err != nil {
+		return nil, err
+	}
+
+	frame := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0F,
+	}
+
+	if header[0]&0x70 != 0 {
+		return nil, &CloseError{WS_CLOSE_PROTOCOL_ERROR, "reserved bits are set"}
+	}
+
+	//clients must mask all frames
+	if header[1]&0x80 == 0 {
+		return nil, &CloseError{WS_CLOSE_PROTOCOL_ERROR, "frame is not masked"}
+	}
+
+	length := int64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return nil, err
+		}
+		if ext[0]&0x80 != 0 {
+			return nil, &CloseError{WS_CLOSE_PROTOCOL_ERROR, "invalid frame length"}
+		}
+		length = int64(binary.BigEndian.Uint64(ext))
+	}
+
+	if frame.opcode >= wsClose {
+		if length > 125 || !frame.fin {
+			return nil, &CloseError{WS_CLOSE_PROTOCOL_ERROR, "invalid control frame"}
+		}
+	} else if length > limit {
+		return nil, &CloseError{WS_CLOSE_MESSAGE_TOO_BIG, ErrMessageTooBig.Error()}
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return nil, err
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, frame.payload); err != nil {
+		return nil, err
+	}
+
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+
+	return frame, nil
+}
+
+//checks whether a close code can be sent by a client
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1011:
+		return code != 1004 && code != WS_CLOSE_NO_STATUS && code != WS_CLOSE_ABNORMAL
+	}
+
+	return false
+}
+
+//answers a close frame from the client, and returns it as an error
+func (ws *WebSocket) closeReceived(payload []byte) error {
+	received := &CloseError{Code: WS_CLOSE_NO_STATUS}
+
+	switch {
+	case len(payload) == 1:
+		received = &CloseError{WS_CLOSE_PROTOCOL_ERROR, "invalid close frame"}
+	case len(payload) >= 2:
+		received.Code = int(binary.BigEndian.Uint16(payload))
+		received.Reason = string(payload[2:])
+
+		if !validCloseCode(received.Code) {
+			received = &CloseError{WS_CLOSE_PROTOCOL_ERROR, "invalid close code"}
+		} else if !utf8.Valid(payload[2:]) {
+			received = &CloseError{WS_CLOSE_INVALID_PAYLOAD, "invalid close reason"}
+		}
+	}
+
+	//echo the code
+	code := received.Code
+	if code == WS_CLOSE_NO_STATUS {
+		code = WS_CLOSE_NORMAL
+	}
+	ws.Close(code, "")
+
+	return received
+}
+
+//fails the connection: sends a close frame and returns err
+func (ws *WebSocket) fail(err error) error {
+	if close_err, ok := err.(*CloseError); ok {
+		ws.Close(close_err.Code, close_err.Reason)
+		return err
+	}
+
+	//network errors, i.e. the client disconnected
+	ws.writeLock.Lock()
+	ws.closed = true
+	ws.conn.Close()
+	ws.writeLock.Unlock()
+
+	return err
+}
+
+//Reads the next message, and returns its type (WS_TEXT or WS_BINARY).
+//Pings are answered while waiting for a message. Returns a *CloseError when
+//the client closes the connection, or when the client breaks the protocol,
+//in which case the connection is closed as well.
+func (ws *WebSocket) ReadMessage() (message_type int, data []byte, err error) {
+	message_type = -1
+
+	for {
+		frame, err := ws.readFrame(ws.MaxMessageSize - int64(len(data)))
+		if err != nil {
+			return -1, nil, ws.fail(err)
+		}
+
+		switch frame.opcode {
+		case wsPing:
+			if err = ws.writeFrame(wsPong, frame.payload); err != nil {
+				return -1, nil, ws.fail(err)
+			}
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			return -1, nil, ws.closeReceived(frame.payload)
+
+		case wsText, wsBinary:
+			if message_type != -1 {
+				return -1, nil, ws.fail(&CloseError{WS_CLOSE_PROTOCOL_ERROR, "expected a continuation frame"})
+			}
+			message_type = int(frame.opcode)
+
+		case wsContinuation:
+			if message_type == -1 {
+				return -1, nil, ws.fail(&CloseError{WS_CLOSE_PROTOCOL_ERROR, "unexpected continuation frame"})
+			}
+
+		default:
+			return -1, nil, ws.fail(&CloseError{WS_CLOSE_PROTOCOL_ERROR, "unknown opcode"})
+		}
+
+		data = append(data, frame.payload...)
+
+		if frame.fin {
+			break
+		}
+	}
+
+	if message_type == WS_TEXT && !utf8.Valid(data) {
+		return -1, nil, ws.fail(&CloseError{WS_CLOSE_INVALID_PAYLOAD, "invalid UTF-8"})
+	}
+
+	return message_type, data, nil
+}
+
+//Reads the next text message
+func (ws *WebSocket) ReadText() (string, error) {
+	message_type, data, err := ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+
+	if message_type != WS_TEXT {
+		return "", ws.fail(&CloseError{WS_CLOSE_UNSUPPORTED_DATA, "expected a text message"})
+	}
+
+	return string(data), nil
+}
+
+//Reads the next message and decodes it as JSON into v
+func (ws *WebSocket) ReadJSON(v interface{}) error {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+//Sends a message of type WS_TEXT or WS_BINARY
+func (ws *WebSocket) WriteMessage(message_type int, data []byte) error {
+	if message_type != WS_TEXT && message_type != WS_BINARY {
+		return fmt.Errorf("invalid WebSocket message type %d", message_type)
+	}
+
+	return ws.writeFrame(byte(message_type), data)
+}
+
+//Sends a text message
+func (ws *WebSocket) WriteText(text string) error {
+	return ws.writeFrame(wsText, []byte(text))
+}
+
+//Sends v as a JSON text message
+func (ws *WebSocket) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ws.writeFrame(wsText, data)
+}
+
+//Sends a ping. The client's pong is handled by ReadMessage.
+func (ws *WebSocket) Ping(data []byte) error {
+	if len(data) > 125 {
+		return fmt.Errorf("WebSocket ping payload is longer than 125 bytes")
+	}
+
+	return ws.writeFrame(wsPing, data)
+}
+
+//Sets the deadline for reading the next message, i.e. to drop idle clients
+func (ws *WebSocket) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+//Returns the address of the client
+func (ws *WebSocket) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+//Sends a close frame with code and reason, then closes the connection.
+//Calling Close more than once has no effect.
+func (ws *WebSocket) Close(code int, reason string) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	if ws.closed {
+		return nil
+	}
+
+	//the reason must fit in a control frame
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	err := ws.writeFrameLocked(wsClose, payload)
+
+	if close_err := ws.conn.Close(); err == nil {
+		err = close_err
+	}
+
+	return err
+}
@@ -0,0 +1,403 @@
+package perfect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//a minimal WebSocket client, which can also break the protocol
+type wsTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+//sends a handshake to server and returns the response
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, header map[string]string) (*wsTestClient, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request, _ := http.NewRequest("GET", server.URL+path, nil)
+	request.Header.Set("Connection", "keep-alive, Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+
+	if err := request.Write(conn); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	return &wsTestClient{t: t, conn: conn, reader: reader}, response
+}
+
+func (c *wsTestClient) writeFrame(fin bool, opcode byte, payload []byte, masked bool) {
+	header := []byte{opcode, byte(len(payload))}
+	if fin {
+		header[0] |= 0x80
+	}
+
+	if len(payload) > 125 {
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	}
+
+	data := append([]byte{}, payload...)
+
+	if masked {
+		header[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		header = append(header, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		c.t.Fatalf("err = %v", err)
+	}
+}
+
+func (c *wsTestClient) readFrame() (opcode byte, payload []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		c.t.Fatalf("err = %v", err)
+	}
+
+	if header[1]&0x80 != 0 {
+		c.t.Fatalf("the server masked a frame")
+	}
+
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(c.reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatalf("err = %v", err)
+	}
+
+	return header[0] & 0x0F, payload
+}
+
+//reads a close frame, and returns its code
+func (c *wsTestClient) readClose() int {
+	opcode, payload := c.readFrame()
+	if opcode != wsClose || len(payload) < 2 {
+		c.t.Fatalf("opcode = %v, payload = %q, expected a close frame", opcode, payload)
+	}
+
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+//returns a server with an echo endpoint
+func newWebSocketTestServer(t *testing.T, closed chan error) *httptest.Server {
+	return httptest.NewServer(newWebSocketTestMux(closed))
+}
+
+//returns a mux with an echo endpoint
+func newWebSocketTestMux(closed chan error) *ModuleMux {
+	module := &Module{Name: "ws", Mux: NewPrettyMux()}
+
+	module.WebSocket("/echo/:room", func(ws *WebSocket, r *Request) {
+		ws.MaxMessageSize = 200
+
+		//the request is available, i.e. for authentication
+		cookie, _ := r.Cookie(SESSION_ID)
+		ws.WriteJSON(map[string]string{"room": r.Values.Get("room"), "session": cookie})
+
+		for {
+			message_type, data, err := ws.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+
+			ws.WriteMessage(message_type, data)
+		}
+	}, "echo")
+
+	mux := NewModuleMux()
+	mux.Mount(module, "/")
+
+	return mux
+}
+
+func TestWebSocket(t *testing.T) {
+	closed := make(chan error, 1)
+	server := newWebSocketTestServer(t, closed)
+	defer server.Close()
+
+	client, response := dialWebSocket(t, server, "/echo/lobby", map[string]string{
+		"Cookie": SESSION_ID + "=abc",
+		"Origin": server.URL,
+	})
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %v, expected %v", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	//the example from RFC 6455
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %v", accept)
+	}
+
+	opcode, payload := client.readFrame()
+	if opcode != wsText || string(payload) != `{"room":"lobby","session":"abc"}` {
+		t.Errorf("opcode = %v, payload = %s", opcode, payload)
+	}
+
+	//text and binary messages
+	client.writeFrame(true, wsText, []byte("hello"), true)
+	if opcode, payload = client.readFrame(); opcode != wsText || string(payload) != "hello" {
+		t.Errorf("opcode = %v, payload = %q", opcode, payload)
+	}
+
+	long := strings.Repeat("x", 150)
+	client.writeFrame(true, wsBinary, []byte(long), true)
+	if opcode, payload = client.readFrame(); opcode != wsBinary || string(payload) != long {
+		t.Errorf("opcode = %v, payload = %q", opcode, payload)
+	}
+
+	//fragmented message, with a ping in the middle
+	client.writeFrame(false, wsText, []byte("Hel"), true)
+	client.writeFrame(true, wsPing, []byte("are you there"), true)
+	client.writeFrame(false, wsContinuation, []byte("lo, "), true)
+	client.writeFrame(true, wsContinuation, []byte("world"), true)
+
+	if opcode, payload = client.readFrame(); opcode != wsPong || string(payload) != "are you there" {
+		t.Errorf("opcode = %v, payload = %q, expected a pong", opcode, payload)
+	}
+
+	if opcode, payload = client.readFrame(); opcode != wsText || string(payload) != "Hello, world" {
+		t.Errorf("opcode = %v, payload = %q", opcode, payload)
+	}
+
+	//closing handshake
+	client.writeFrame(true, wsClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}, true)
+
+	if code := client.readClose(); code != WS_CLOSE_NORMAL {
+		t.Errorf("close code = %v, expected %v", code, WS_CLOSE_NORMAL)
+	}
+
+	err := <-closed
+	if close_err, ok := err.(*CloseError); !ok || close_err.Code != WS_CLOSE_NORMAL || close_err.Reason != "bye" {
+		t.Errorf("err = %#v", err)
+	}
+}
+
+//tests that server timeouts don't apply to upgraded connections
+func TestWebSocket_ServerTimeouts(t *testing.T) {
+	closed := make(chan error, 1)
+	server := httptest.NewUnstartedServer(newWebSocketTestMux(closed))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	client, response := dialWebSocket(t, server, "/echo/lobby", map[string]string{"Origin": server.URL})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %v, expected %v", response.StatusCode, http.StatusSwitchingProtocols)
+	}
+	client.readFrame()
+
+	time.Sleep(300 * time.Millisecond)
+
+	client.writeFrame(true, wsText, []byte("still here"), true)
+	if opcode, payload := client.readFrame(); opcode != wsText || string(payload) != "still here" {
+		t.Errorf("opcode = %v, payload = %q", opcode, payload)
+	}
+
+	select {
+	case err := <-closed:
+		t.Errorf("the socket was closed: %v", err)
+	default:
+	}
+
+	//hijackers that keep the deadlines of the server's timeouts
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+	server_conn.SetDeadline(time.Now().Add(-time.Second))
+
+	go func() {
+		reader := bufio.NewReader(client_conn)
+		if response, err := http.ReadResponse(reader, nil); err == nil {
+			response.Body.Close()
+		}
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	request, _ := http.NewRequest("GET", "http://localhost/echo", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	w := &deadlineHijacker{ResponseRecorder: httptest.NewRecorder(), conn: server_conn}
+	ws, err := NewRequest(request, "/echo", &Module{}).UpgradeWebSocket(w)
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	if err := ws.WriteMessage(wsText, []byte("hello")); err != nil {
+		t.Errorf("err = %v", err)
+	}
+	ws.conn.Close()
+}
+
+//a response writer whose connection keeps the deadlines that a server's
+//timeouts set on it
+type deadlineHijacker struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *deadlineHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+func TestWebSocket_ProtocolErrors(t *testing.T) {
+	closed := make(chan error, 1)
+	server := newWebSocketTestServer(t, closed)
+	defer server.Close()
+
+	tests := []struct {
+		Name   string
+		Frames func(c *wsTestClient)
+		Code   int
+	}{
+		{"unmasked", func(c *wsTestClient) {
+			c.writeFrame(true, wsText, []byte("hi"), false)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"too big", func(c *wsTestClient) {
+			c.writeFrame(true, wsText, []byte(strings.Repeat("x", 201)), true)
+		}, WS_CLOSE_MESSAGE_TOO_BIG},
+		{"fragments too big", func(c *wsTestClient) {
+			c.writeFrame(false, wsText, []byte(strings.Repeat("x", 150)), true)
+			c.writeFrame(true, wsContinuation, []byte(strings.Repeat("x", 51)), true)
+		}, WS_CLOSE_MESSAGE_TOO_BIG},
+		{"unexpected continuation", func(c *wsTestClient) {
+			c.writeFrame(true, wsContinuation, []byte("hi"), true)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"interleaved messages", func(c *wsTestClient) {
+			c.writeFrame(false, wsText, []byte("a"), true)
+			c.writeFrame(true, wsText, []byte("b"), true)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"fragmented ping", func(c *wsTestClient) {
+			c.writeFrame(false, wsPing, []byte("a"), true)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"unknown opcode", func(c *wsTestClient) {
+			c.writeFrame(true, 0x3, []byte("a"), true)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"invalid utf-8", func(c *wsTestClient) {
+			c.writeFrame(true, wsText, []byte{0xff, 0xfe}, true)
+		}, WS_CLOSE_INVALID_PAYLOAD},
+		{"invalid close code", func(c *wsTestClient) {
+			c.writeFrame(true, wsClose, []byte{0x03, 0xED}, true)
+		}, WS_CLOSE_PROTOCOL_ERROR},
+		{"empty close", func(c *wsTestClient) {
+			c.writeFrame(true, wsClose, nil, true)
+		}, WS_CLOSE_NORMAL},
+	}
+
+	for _, test := range tests {
+		client, response := dialWebSocket(t, server, "/echo/lobby", nil)
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%v: status = %v", test.Name, response.StatusCode)
+		}
+
+		//the welcome message
+		client.readFrame()
+
+		test.Frames(client)
+
+		if code := client.readClose(); code != test.Code {
+			t.Errorf("%v: close code = %v, expected %v", test.Name, code, test.Code)
+		}
+
+		<-closed
+		client.conn.Close()
+	}
+}
+
+func TestWebSocket_Handshake(t *testing.T) {
+	closed := make(chan error, 1)
+	server := newWebSocketTestServer(t, closed)
+	defer server.Close()
+
+	tests := []struct {
+		Name   string
+		Header map[string]string
+		Status int
+	}{
+		{"not an upgrade", map[string]string{"Upgrade": "h2c"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"invalid key", map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, http.StatusBadRequest},
+		{"other origin", map[string]string{"Origin": "http://evil.example.com"}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		client, response := dialWebSocket(t, server, "/echo/lobby", test.Header)
+		client.conn.Close()
+
+		if response.StatusCode != test.Status {
+			t.Errorf("%v: status = %v, expected %v", test.Name, response.StatusCode, test.Status)
+		}
+	}
+
+	//plain requests
+	response, err := http.Get(server.URL + "/echo/lobby")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %v, expected %v", response.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestWebSocket_Routes(t *testing.T) {
+	handler := func(ws *WebSocket, r *Request) {}
+
+	for _, mux := range []Mux{NewHTTPMux(), NewPrettyMux()} {
+		mux.Group("/api").WebSocket("/live", handler, "live")
+
+		routes := mux.Routes()
+		if len(routes) != 1 {
+			t.Fatalf("routes = %v", routes)
+		}
+
+		if routes[0].Method != "GET" || routes[0].Pattern != "/api/live" || !strings.Contains(routes[0].Handler, "TestWebSocket_Routes") {
+			t.Errorf("route = %#v", routes[0])
+		}
+
+		if path, err := mux.BuildPath("live", nil); err != nil || path != "/api/live" {
+			t.Errorf("path = %v, err = %v", path, err)
+		}
+	}
+}